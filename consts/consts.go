@@ -10,6 +10,16 @@ const (
 	G                   = 1024 * M
 	FileBufferSize      = 64 * K
 	FileSortShardSize   = 16 * M
+	MemoryBudget        = 1 * G
+	ShardBlockSize      = 1 * M
+	ShardCompress       = false
+	MaxFanIn            = 64
+	MaxOpenFiles        = 1024
+	DiskQuota           = 0
+	MergeRanges         = 4
+	TopologyInterval    = 30
+	FileChunkSize       = 256 * M
+	ShardingLimit       = 8
 	FileMergeBufferSize = 32 * M
 	InsertBatch         = 256 * K
 	FileSortLimit       = 1
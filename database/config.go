@@ -0,0 +1,189 @@
+package database
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"fmt"
+	"github.com/go-sql-driver/mysql"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Config is the connection to a target. A DSN is taken as is, the other
+// options are applied over it or over the defaults without one. Durations
+// read from yaml are like 5s.
+type Config struct {
+	DSN      string `json:"dsn" yaml:"dsn"`
+	Host     string `json:"host" yaml:"host"`
+	Port     int    `json:"port" yaml:"port"`
+	Socket   string `json:"socket" yaml:"socket"`
+	User     string `json:"user" yaml:"user"`
+	Password string `json:"password" yaml:"password"`
+	TLS      TLS    `json:"tls" yaml:"tls"`
+
+	DialTimeout  time.Duration `json:"dial_timeout" yaml:"dial_timeout"`
+	ReadTimeout  time.Duration `json:"read_timeout" yaml:"read_timeout"`
+	WriteTimeout time.Duration `json:"write_timeout" yaml:"write_timeout"`
+
+	Charset   string `json:"charset" yaml:"charset"`
+	Collation string `json:"collation" yaml:"collation"`
+	// Session holds the variables set on every connection, values are sql
+	// literals, e.g. sql_mode: "'NO_ENGINE_SUBSTITUTION'".
+	Session map[string]string `json:"session" yaml:"session"`
+
+	MaxOpenConns    int           `json:"max_open_conns" yaml:"max_open_conns"`
+	MaxIdleConns    int           `json:"max_idle_conns" yaml:"max_idle_conns"`
+	ConnMaxIdleTime time.Duration `json:"conn_max_idle_time" yaml:"conn_max_idle_time"`
+}
+
+// TLS enables tls when any option is set, CA verifies the server and Cert
+// and Key authenticate the client.
+type TLS struct {
+	CA         string `json:"ca" yaml:"ca"`
+	Cert       string `json:"cert" yaml:"cert"`
+	Key        string `json:"key" yaml:"key"`
+	ServerName string `json:"server_name" yaml:"server_name"`
+	SkipVerify bool   `json:"skip_verify" yaml:"skip_verify"`
+}
+
+func (t TLS) enabled() bool {
+	return t.CA != "" || t.Cert != "" || t.ServerName != "" || t.SkipVerify
+}
+
+// tlsConfigs numbers the tls configs registered with the driver.
+var tlsConfigs int32
+
+func (t TLS) register() (string, error) {
+	conf := &tls.Config{ServerName: t.ServerName, InsecureSkipVerify: t.SkipVerify}
+	if t.CA != "" {
+		pem, err := ioutil.ReadFile(t.CA)
+		if err != nil {
+			return "", err
+		}
+		conf.RootCAs = x509.NewCertPool()
+		if !conf.RootCAs.AppendCertsFromPEM(pem) {
+			return "", fmt.Errorf("tls ca %s: no certificates", t.CA)
+		}
+	}
+	if t.Cert != "" || t.Key != "" {
+		cert, err := tls.LoadX509KeyPair(t.Cert, t.Key)
+		if err != nil {
+			return "", err
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	name := fmt.Sprintf("target_%d", atomic.AddInt32(&tlsConfigs, 1))
+	return name, mysql.RegisterTLSConfig(name, conf)
+}
+
+// target identifies the server of a config.
+func (c Config) target() string {
+	return fmt.Sprintf("%s|%s|%s:%d", c.DSN, c.Socket, c.Host, c.Port)
+}
+
+func (c Config) driverConfig() (*mysql.Config, error) {
+	mc := mysql.NewConfig()
+	if c.DSN != "" {
+		var err error
+		mc, err = mysql.ParseDSN(c.DSN)
+		if err != nil {
+			return nil, err
+		}
+		if !dsnParam(c.DSN, "maxAllowedPacket") {
+			mc.MaxAllowedPacket = 1 << 30
+		}
+	} else {
+		mc.Net, mc.Addr = "tcp", "127.0.0.1:3306"
+		mc.MaxAllowedPacket = 1 << 30
+	}
+	if c.Socket != "" {
+		mc.Net, mc.Addr = "unix", c.Socket
+	} else if c.Host != "" {
+		port := c.Port
+		if port == 0 {
+			port = 3306
+		}
+		mc.Net, mc.Addr = "tcp", net.JoinHostPort(c.Host, strconv.Itoa(port))
+	}
+	if c.User != "" {
+		mc.User, mc.Passwd = c.User, c.Password
+	}
+	if c.TLS.enabled() {
+		name, err := c.TLS.register()
+		if err != nil {
+			return nil, err
+		}
+		mc.TLSConfig = name
+	}
+	if c.DialTimeout > 0 {
+		mc.Timeout = c.DialTimeout
+	}
+	if c.ReadTimeout > 0 {
+		mc.ReadTimeout = c.ReadTimeout
+	}
+	if c.WriteTimeout > 0 {
+		mc.WriteTimeout = c.WriteTimeout
+	}
+	if mc.Params == nil {
+		mc.Params = map[string]string{}
+	}
+	if c.Charset != "" {
+		mc.Params["charset"] = c.Charset
+	}
+	if c.Collation != "" {
+		mc.Collation = c.Collation
+	}
+	for k, v := range c.Session {
+		mc.Params[k] = v
+	}
+	return mc, nil
+}
+
+func (c Config) maxIdle() int {
+	if c.MaxIdleConns > 0 {
+		return c.MaxIdleConns
+	}
+	return 100
+}
+
+func open(c Config) (*sql.DB, error) {
+	mc, err := c.driverConfig()
+	if err != nil {
+		return nil, err
+	}
+	connector, err := mysql.NewConnector(mc)
+	if err != nil {
+		return nil, err
+	}
+	db := sql.OpenDB(connector)
+	db.SetConnMaxIdleTime(60 * time.Second)
+	db.SetMaxIdleConns(c.maxIdle())
+	db.SetMaxOpenConns(500)
+	if c.ConnMaxIdleTime > 0 {
+		db.SetConnMaxIdleTime(c.ConnMaxIdleTime)
+	}
+	if c.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(c.MaxOpenConns)
+	}
+	return db, nil
+}
+
+// dsnParam tells whether a dsn sets a parameter.
+func dsnParam(dsn, name string) bool {
+	i := strings.LastIndexByte(dsn, '?')
+	if i == -1 {
+		return false
+	}
+	params, err := url.ParseQuery(dsn[i+1:])
+	if err != nil {
+		return false
+	}
+	_, ok := params[name]
+	return ok
+}
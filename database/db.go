@@ -1,29 +1,52 @@
 package database
 
 import (
-	"context"
 	"database/sql"
 	"fmt"
 	_ "github.com/go-sql-driver/mysql"
 	"strconv"
 	"strings"
-	"time"
+	"sync"
 )
 
+// Charset and Collation are used for the databases created on the target.
+const (
+	Charset   = "utf8mb4"
+	Collation = "utf8mb4_bin"
+)
+
+// Buckets is the number of hash buckets the topology maps to sets.
+const Buckets = 64
+
+// PlainSet names the only set of a target without a proxy.
+const PlainSet = "plain"
+
 type DB struct {
-	db   *sql.DB
-	sets []string
-	hash []string
+	db    *sql.DB
+	proxy bool
+	// topology guards sets and hash, replaced whole when the proxy reports
+	// new hash ranges, and version counts the changes.
+	topology sync.RWMutex
+	sets     []string
+	hash     []string
+	version  int
+	// shards are the pools of the sets of a client sharded target, each set
+	// is its own server.
+	shards map[string]*sql.DB
+	// pools keep the connections handed to loaders per set.
+	poolsLock sync.Mutex
+	pools     map[string]*Pool
+	poolOrder []string
+	session   []string
+	maxIdle   int
 }
 
-func New(ip string, port int, user, pwd string) (*DB, error) {
-	db, err := sql.Open("mysql", fmt.Sprintf("%s:%s@tcp(%s:%d)/?maxAllowedPacket=1073741824", user, pwd, ip, port))
+// New connects to a target, a TDSQL proxy or a plain MySQL or MariaDB server.
+func New(c Config) (*DB, error) {
+	db, err := open(c)
 	if err != nil {
 		return nil, err
 	}
-	db.SetConnMaxIdleTime(60 * time.Second)
-	db.SetMaxIdleConns(100)
-	db.SetMaxOpenConns(500)
 
 	// test
 	//ctx := context.Background()
@@ -48,12 +71,25 @@ func New(ip string, port int, user, pwd string) (*DB, error) {
 	//}
 	//panic(1)
 
+	status, err := readStatus(db)
+	if err != nil {
+		return nil, err
+	}
+	d := &DB{db: db, maxIdle: c.maxIdle()}
+	d.proxy, d.sets, d.hash, err = topology(status)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func readStatus(db *sql.DB) ([][2]string, error) {
 	res, err := db.Query("/*proxy*/ show status")
 	if err != nil {
 		return nil, err
 	}
-	sets := make([]string, 0)
-	hash := make([]string, 64)
+	defer res.Close()
+	status := make([][2]string, 0)
 	for res.Next() {
 		name := ""
 		value := ""
@@ -61,44 +97,158 @@ func New(ip string, port int, user, pwd string) (*DB, error) {
 		if err != nil {
 			return nil, err
 		}
+		status = append(status, [2]string{name, value})
+	}
+	return status, res.Err()
+}
+
+// Move is a bucket the proxy reassigned to another set.
+type Move struct {
+	Bucket   int
+	From, To string
+}
+
+// Refresh re-reads the hash ranges of the proxy and returns the buckets
+// that moved since the last read, the topology of other targets is fixed.
+func (d *DB) Refresh() ([]Move, error) {
+	if !d.proxy {
+		return nil, nil
+	}
+	status, err := readStatus(d.db)
+	if err != nil {
+		return nil, err
+	}
+	proxy, sets, hash, err := topology(status)
+	if err != nil {
+		return nil, err
+	}
+	if !proxy {
+		return nil, fmt.Errorf("proxy reports no hash ranges")
+	}
+	d.topology.Lock()
+	defer d.topology.Unlock()
+	moves := make([]Move, 0)
+	for i := range hash {
+		if hash[i] != d.hash[i] {
+			moves = append(moves, Move{Bucket: i, From: d.hash[i], To: hash[i]})
+		}
+	}
+	if len(moves) > 0 || strings.Join(sets, ",") != strings.Join(d.sets, ",") {
+		d.sets, d.hash = sets, hash
+		d.version++
+	}
+	return moves, nil
+}
+
+// topology reads the sets and their hash ranges from the proxy status. A
+// plain MySQL or MariaDB target reports no hash ranges, it is one set
+// holding every bucket.
+func topology(status [][2]string) (bool, []string, []string, error) {
+	sets := make([]string, 0)
+	hash := make([]string, Buckets)
+	for _, kv := range status {
+		name, value := kv[0], kv[1]
 		if strings.HasSuffix(name, "hash_range") {
 			set := strings.Split(name, ":")[0]
 			sets = append(sets, set)
-			rg := strings.Split(value, "---")
-			left, _ := strconv.ParseInt(rg[0], 10, 64)
-			right, _ := strconv.ParseInt(rg[1], 10, 64)
-			for i := left; i <= right; i++ {
-				hash[i] = set
+			if err := fillRange(hash, set, value); err != nil {
+				return false, nil, nil, err
 			}
 		}
 	}
-	return &DB{
-		db:   db,
-		sets: sets,
-		hash: hash,
-	}, nil
+	if len(sets) > 0 {
+		for i, set := range hash {
+			if set == "" {
+				return false, nil, nil, fmt.Errorf("proxy reports incomplete hash ranges, bucket %d without a set", i)
+			}
+		}
+		return true, sets, hash, nil
+	}
+	for i := range hash {
+		hash[i] = PlainSet
+	}
+	return false, []string{PlainSet}, hash, nil
+}
+
+// fillRange assigns the buckets of a first---last hash range to a set.
+func fillRange(hash []string, set, value string) error {
+	rg := strings.Split(value, "---")
+	if len(rg) != 2 {
+		return fmt.Errorf("set %s: invalid hash range %s", set, value)
+	}
+	left, err := strconv.ParseInt(rg[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("set %s: invalid hash range %s", set, value)
+	}
+	right, err := strconv.ParseInt(rg[1], 10, 64)
+	if err != nil || left < 0 || right >= Buckets || left > right {
+		return fmt.Errorf("set %s: invalid hash range %s", set, value)
+	}
+	for i := left; i <= right; i++ {
+		hash[i] = set
+	}
+	return nil
 }
 
-func (d *DB) Exec(sql string, args ...interface{}) (sql.Result, error) {
-	return d.db.Exec(sql, args...)
+// pool returns the pool reaching a set.
+func (d *DB) pool(set string) *sql.DB {
+	if db, ok := d.shards[set]; ok {
+		return db
+	}
+	return d.db
 }
 
-func (d *DB) Query(sql string, args ...interface{}) (*sql.Rows, error) {
-	return d.db.Query(sql, args...)
+func (d *DB) Exec(set, sql string, args ...interface{}) (sql.Result, error) {
+	return d.pool(set).Exec(sql, args...)
+}
+
+func (d *DB) Query(set, sql string, args ...interface{}) (*sql.Rows, error) {
+	return d.pool(set).Query(sql, args...)
 }
 
 func (d *DB) Begin() (*sql.Tx, error) {
 	return d.db.Begin()
 }
 
-func (d DB) Hash() []string {
+// SetTopology replaces the sets and the set of each hash bucket.
+func (d *DB) SetTopology(sets, hash []string) {
+	d.topology.Lock()
+	defer d.topology.Unlock()
+	d.sets = sets
+	d.hash = hash
+	d.version++
+}
+
+func (d *DB) Hash() []string {
+	d.topology.RLock()
+	defer d.topology.RUnlock()
 	return d.hash
 }
 
-func (d DB) Sets() []string {
+func (d *DB) Sets() []string {
+	d.topology.RLock()
+	defer d.topology.RUnlock()
 	return d.sets
 }
 
-func (d *DB) GetConn(ctx context.Context) (*sql.Conn, error) {
-	return d.db.Conn(ctx)
+// Version counts the topology changes.
+func (d *DB) Version() int {
+	d.topology.RLock()
+	defer d.topology.RUnlock()
+	return d.version
+}
+
+// Proxy tells whether the target is a TDSQL proxy routing by set hints and
+// shard keys, or a plain MySQL or MariaDB server.
+func (d *DB) Proxy() bool {
+	return d.proxy
+}
+
+// Hint returns the comment routing a statement to a set, empty without a
+// proxy.
+func (d *DB) Hint(set string) string {
+	if !d.proxy {
+		return ""
+	}
+	return fmt.Sprintf("/*sets:%s*/ ", set)
 }
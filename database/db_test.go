@@ -0,0 +1,94 @@
+package database
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTopology(t *testing.T) {
+	proxy, sets, hash, err := topology([][2]string{
+		{"set_1:hash_range", "0---31"},
+		{"set_1:status", "ok"},
+		{"set_2:hash_range", "32---63"},
+	})
+	if err != nil || !proxy || len(sets) != 2 || hash[31] != "set_1" || hash[32] != "set_2" {
+		t.Fatalf("unexpected topology %v %v %v", sets, hash, err)
+	}
+	for _, status := range [][][2]string{
+		{{"set_1:hash_range", "0---31"}},
+		{{"set_1:hash_range", "0---31"}, {"set_2:hash_range", "32---64"}},
+		{{"set_1:hash_range", "0-31"}, {"set_2:hash_range", "32---63"}},
+	} {
+		if _, _, _, err = topology(status); err == nil {
+			t.Fatalf("expect %v to fail", status)
+		}
+	}
+	proxy, sets, hash, err = topology([][2]string{{"Uptime", "10"}})
+	if err != nil || proxy || len(sets) != 1 || sets[0] != PlainSet || hash[0] != PlainSet || hash[Buckets-1] != PlainSet {
+		t.Fatalf("expect a plain target, got %v %v", sets, hash)
+	}
+	d := &DB{proxy: proxy}
+	if d.Hint(PlainSet) != "" {
+		t.Fatalf("expect no hint without a proxy")
+	}
+}
+
+func TestShardTopology(t *testing.T) {
+	sets, hash, err := shardTopology([]Shard{
+		{Set: "a", Config: Config{DSN: "u@tcp(a:3306)/"}, HashRange: "0---15"},
+		{Set: "b", Config: Config{DSN: "u@tcp(b:3306)/"}, HashRange: "16---63"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sets) != 2 || hash[15] != "a" || hash[16] != "b" {
+		t.Fatalf("unexpected topology %v %v", sets, hash)
+	}
+	for _, shards := range [][]Shard{
+		{{Set: "a", Config: Config{DSN: "u@tcp(a:3306)/"}, HashRange: "0---31"}},
+		{{Set: "a", Config: Config{DSN: "u@tcp(a:3306)/"}, HashRange: "0---40"}, {Set: "b", Config: Config{DSN: "u@tcp(b:3306)/"}, HashRange: "32---63"}},
+		{{Set: "a", Config: Config{DSN: "u@tcp(a:3306)/"}, HashRange: "0---64"}},
+		{{Set: "a", Config: Config{DSN: "u@tcp(a:3306)/"}, HashRange: "0---31"}, {Set: "a", Config: Config{DSN: "u@tcp(c:3306)/"}, HashRange: "32---63"}},
+	} {
+		if _, _, err = shardTopology(shards); err == nil {
+			t.Fatalf("expect %+v to fail", shards)
+		}
+	}
+}
+
+func TestConfig(t *testing.T) {
+	mc, err := Config{Host: "db", User: "u", Password: "p", ReadTimeout: time.Second, Charset: "utf8mb4",
+		Session: map[string]string{"sql_mode": "'NO_ENGINE_SUBSTITUTION'"}}.driverConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mc.Net != "tcp" || mc.Addr != "db:3306" || mc.User != "u" || mc.ReadTimeout != time.Second ||
+		mc.MaxAllowedPacket != 1<<30 || mc.Params["charset"] != "utf8mb4" || mc.Params["sql_mode"] == "" {
+		t.Fatalf("unexpected config %+v", mc)
+	}
+	mc, err = Config{DSN: "u:p@tcp(a:1)/?maxAllowedPacket=1024", Socket: "/tmp/mysql.sock"}.driverConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mc.Net != "unix" || mc.Addr != "/tmp/mysql.sock" || mc.MaxAllowedPacket != 1024 || mc.Passwd != "p" {
+		t.Fatalf("unexpected config %+v", mc)
+	}
+	// a dsn without maxAllowedPacket keeps room for whole insert batches
+	if mc, err = (Config{DSN: "u:p@tcp(a:1)/"}).driverConfig(); err != nil || mc.MaxAllowedPacket != 1<<30 {
+		t.Fatalf("expect a 1GB packet, got %+v %v", mc, err)
+	}
+	path := filepath.Join(t.TempDir(), "dst.yaml")
+	err = ioutil.WriteFile(path, []byte("host: db\ndial_timeout: 5s\ntls: {skip_verify: true}\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := ReadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.DialTimeout != 5*time.Second || !c.TLS.SkipVerify {
+		t.Fatalf("unexpected config %+v", c)
+	}
+}
@@ -0,0 +1,233 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"github.com/go-sql-driver/mysql"
+	"sync/atomic"
+	"time"
+)
+
+// ValidateAfter is how long a connection may idle before it is pinged when
+// handed out again.
+var ValidateAfter = 10 * time.Second
+
+// Pool keeps the connections of a set with their session set up, so that a
+// loader gets a checked connection and the session statements run once
+// per connection.
+type Pool struct {
+	set  string
+	d    *DB
+	db   *sql.DB
+	idle chan *Conn
+
+	open     int64
+	inUse    int64
+	acquired int64
+	created  int64
+	recycled int64
+	failed   int64
+}
+
+// PoolStats are the counters of the pool of a set.
+type PoolStats struct {
+	Set      string
+	Open     int64
+	Idle     int
+	InUse    int64
+	Acquired int64
+	Created  int64
+	Recycled int64
+	Failed   int64
+}
+
+// Conn is a connection of a pool, released back to it once. Every acquire
+// hands out a new Conn, so releasing a Conn again after its connection was
+// handed to another loader does nothing.
+type Conn struct {
+	*sql.Conn
+	pool *Pool
+	// version is the topology version the session was set up for.
+	version  int
+	idle     time.Time
+	released bool
+}
+
+// SetSession sets the statements run on every new connection of the pools.
+// Through a proxy they run without a hint and once for every set, so the
+// sessions of the sets the rows of the connection reach are set too, and
+// again when the topology changed since.
+func (d *DB) SetSession(stmts ...string) {
+	d.poolsLock.Lock()
+	defer d.poolsLock.Unlock()
+	d.session = stmts
+}
+
+// Acquire returns a connection of the pool of a set.
+func (d *DB) Acquire(ctx context.Context, set string) (*Conn, error) {
+	return d.setPool(set).acquire(ctx)
+}
+
+// Stats returns the counters of the pools.
+func (d *DB) Stats() []PoolStats {
+	d.poolsLock.Lock()
+	defer d.poolsLock.Unlock()
+	stats := make([]PoolStats, 0, len(d.pools))
+	for _, set := range d.poolOrder {
+		stats = append(stats, d.pools[set].stats())
+	}
+	return stats
+}
+
+func (d *DB) setPool(set string) *Pool {
+	d.poolsLock.Lock()
+	defer d.poolsLock.Unlock()
+	if p, ok := d.pools[set]; ok {
+		return p
+	}
+	p := &Pool{set: set, d: d, db: d.pool(set), idle: make(chan *Conn, d.maxIdle)}
+	if d.pools == nil {
+		d.pools = map[string]*Pool{}
+	}
+	d.pools[set] = p
+	d.poolOrder = append(d.poolOrder, set)
+	return p
+}
+
+func (p *Pool) acquire(ctx context.Context) (*Conn, error) {
+	for {
+		var c *Conn
+		select {
+		case c = <-p.idle:
+		default:
+		}
+		if c == nil {
+			break
+		}
+		if time.Since(c.idle) > ValidateAfter && c.PingContext(ctx) != nil {
+			p.recycle(c)
+			continue
+		}
+		version := c.version
+		if version != p.d.Version() {
+			var err error
+			version, err = p.setup(ctx, c.Conn)
+			if err != nil {
+				p.recycle(c)
+				continue
+			}
+		}
+		p.hand()
+		return &Conn{Conn: c.Conn, pool: p, version: version}, nil
+	}
+	conn, err := p.db.Conn(ctx)
+	if err != nil {
+		atomic.AddInt64(&p.failed, 1)
+		return nil, err
+	}
+	version, err := p.setup(ctx, conn)
+	if err != nil {
+		_ = conn.Close()
+		atomic.AddInt64(&p.failed, 1)
+		return nil, err
+	}
+	atomic.AddInt64(&p.open, 1)
+	atomic.AddInt64(&p.created, 1)
+	p.hand()
+	return &Conn{Conn: conn, pool: p, version: version}, nil
+}
+
+// setup runs the session statements on a connection, hinted for the sets of
+// the current topology, and returns the version of that topology.
+func (p *Pool) setup(ctx context.Context, conn *sql.Conn) (int, error) {
+	d := p.d
+	d.poolsLock.Lock()
+	session := d.session
+	d.poolsLock.Unlock()
+	version := d.Version()
+	for _, stmt := range session {
+		_, err := conn.ExecContext(ctx, stmt)
+		if err != nil {
+			return 0, err
+		}
+		if !d.Proxy() {
+			continue
+		}
+		for _, set := range d.Sets() {
+			_, err = conn.ExecContext(ctx, d.Hint(set)+stmt)
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+	return version, nil
+}
+
+func (p *Pool) hand() {
+	atomic.AddInt64(&p.inUse, 1)
+	atomic.AddInt64(&p.acquired, 1)
+}
+
+func (p *Pool) recycle(c *Conn) {
+	_ = c.Conn.Close()
+	atomic.AddInt64(&p.open, -1)
+	atomic.AddInt64(&p.recycled, 1)
+}
+
+func (p *Pool) stats() PoolStats {
+	return PoolStats{
+		Set:      p.set,
+		Open:     atomic.LoadInt64(&p.open),
+		Idle:     len(p.idle),
+		InUse:    atomic.LoadInt64(&p.inUse),
+		Acquired: atomic.LoadInt64(&p.acquired),
+		Created:  atomic.LoadInt64(&p.created),
+		Recycled: atomic.LoadInt64(&p.recycled),
+		Failed:   atomic.LoadInt64(&p.failed),
+	}
+}
+
+// Release returns the connection to its pool, err is the last error it
+// returned. A connection that failed other than by a server error may be
+// broken and is closed, as is one the pool has no room for.
+func (c *Conn) Release(err error) {
+	if c.released {
+		return
+	}
+	c.released = true
+	p := c.pool
+	atomic.AddInt64(&p.inUse, -1)
+	if err != nil {
+		if _, ok := err.(*mysql.MySQLError); !ok {
+			p.recycle(c)
+			return
+		}
+	}
+	c.idle = time.Now()
+	select {
+	case p.idle <- c:
+	default:
+		p.recycle(c)
+	}
+}
+
+// Close closes the idle connections of the pools.
+func (d *DB) Close() {
+	d.poolsLock.Lock()
+	defer d.poolsLock.Unlock()
+	for _, p := range d.pools {
+		p.close()
+	}
+}
+
+func (p *Pool) close() {
+	for {
+		select {
+		case c := <-p.idle:
+			_ = c.Conn.Close()
+			atomic.AddInt64(&p.open, -1)
+		default:
+			return
+		}
+	}
+}
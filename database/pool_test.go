@@ -0,0 +1,119 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDriver counts the statements its connections run, a connection
+// fails its pings once broken.
+type fakeDriver struct {
+	sync.Mutex
+	execs  []string
+	broken bool
+}
+
+type fakeConn struct {
+	d *fakeDriver
+}
+
+func (d *fakeDriver) Open(string) (driver.Conn, error) {
+	return &fakeConn{d: d}, nil
+}
+
+func (c *fakeConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("not supported")
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("not supported")
+}
+
+func (c *fakeConn) ExecContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Result, error) {
+	c.d.Lock()
+	defer c.d.Unlock()
+	c.d.execs = append(c.d.execs, query)
+	return driver.RowsAffected(0), nil
+}
+
+func (c *fakeConn) Ping(context.Context) error {
+	c.d.Lock()
+	defer c.d.Unlock()
+	if c.d.broken {
+		return driver.ErrBadConn
+	}
+	return nil
+}
+
+func TestPool(t *testing.T) {
+	defer func(v time.Duration) { ValidateAfter = v }(ValidateAfter)
+	ValidateAfter = 0
+	fd := &fakeDriver{}
+	sql.Register("fake_pool", fd)
+	sdb, err := sql.Open("fake_pool", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &DB{db: sdb, proxy: true, sets: []string{"a", "b"}, maxIdle: 2}
+	d.SetSession("set x=1")
+	ctx := context.Background()
+	c, err := d.Acquire(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fd.execs) != 3 || fd.execs[1] != "/*sets:a*/ set x=1" {
+		t.Fatalf("expect the session set once per set, got %v", fd.execs)
+	}
+	first := c
+	c.Release(nil)
+	c.Release(nil)
+	if c, err = d.Acquire(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if len(fd.execs) != 3 {
+		t.Fatalf("expect the idle connection reused, got %v", fd.execs)
+	}
+	// releasing the earlier handout of the connection leaves it in use
+	first.Release(nil)
+	if st := d.Stats()[0]; st.InUse != 1 || st.Idle != 0 {
+		t.Fatalf("expect the connection still in use, got %+v", st)
+	}
+	// a set added by the topology gets the session on the next acquire
+	c.Release(nil)
+	d.SetTopology([]string{"a", "b", "c"}, d.hash)
+	if c, err = d.Acquire(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if len(fd.execs) != 7 || fd.execs[6] != "/*sets:c*/ set x=1" {
+		t.Fatalf("expect the session set again for the new topology, got %v", fd.execs)
+	}
+	// a connection failing other than by a server error is closed
+	c.Release(driver.ErrBadConn)
+	if c, err = d.Acquire(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	c.Release(nil)
+	// an idle connection failing its ping is replaced
+	fd.broken = true
+	if c, err = d.Acquire(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	st := d.Stats()[0]
+	if st.Set != "a" || st.Open != 1 || st.InUse != 1 || st.Acquired != 5 || st.Created != 3 || st.Recycled != 2 {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+	c.Release(nil)
+	d.Close()
+	if st = d.Stats()[0]; st.Open != 0 || st.Idle != 0 {
+		t.Fatalf("expect the pool closed, got %+v", st)
+	}
+}
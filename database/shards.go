@@ -0,0 +1,117 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"path/filepath"
+)
+
+// Shard is a server of a client sharded target holding the buckets of its
+// hash range, e.g. 0---31, with the options of its connection.
+type Shard struct {
+	Set       string `json:"set" yaml:"set"`
+	HashRange string `json:"hash_range" yaml:"hash_range"`
+	Config    `yaml:",inline"`
+}
+
+// ReadShards loads the shards of a target from a json or yaml file.
+func ReadShards(path string) ([]Shard, error) {
+	conf := struct {
+		Shards []Shard `json:"shards" yaml:"shards"`
+	}{}
+	err := readConfig(path, &conf)
+	return conf.Shards, err
+}
+
+// ReadConfig loads the connection of a target from a json or yaml file.
+func ReadConfig(path string) (Config, error) {
+	c := Config{}
+	err := readConfig(path, &c)
+	return c, err
+}
+
+func readConfig(path string, v interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	switch filepath.Ext(path) {
+	case ".yml", ".yaml":
+		err = yaml.Unmarshal(data, v)
+	default:
+		err = json.Unmarshal(data, v)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+// NewSharded connects to independent MySQL servers sharded by the client,
+// each a set with its own pool. Statements carry no hints, a set's stream
+// goes to its server directly.
+func NewSharded(shards []Shard) (*DB, error) {
+	sets, hash, err := shardTopology(shards)
+	if err != nil {
+		return nil, err
+	}
+	d := &DB{sets: sets, hash: hash, shards: map[string]*sql.DB{}, maxIdle: shards[0].maxIdle()}
+	for _, s := range shards {
+		if _, ok := d.shards[s.Set]; ok {
+			continue
+		}
+		db, err := open(s.Config)
+		if err != nil {
+			return nil, err
+		}
+		if err = db.Ping(); err != nil {
+			return nil, fmt.Errorf("set %s: %v", s.Set, err)
+		}
+		d.shards[s.Set] = db
+	}
+	d.db = d.shards[sets[0]]
+	return d, nil
+}
+
+// shardTopology checks the shards cover every bucket once.
+func shardTopology(shards []Shard) ([]string, []string, error) {
+	if len(shards) == 0 {
+		return nil, nil, fmt.Errorf("no shards")
+	}
+	sets := make([]string, 0)
+	targets := map[string]string{}
+	hash := make([]string, Buckets)
+	for _, s := range shards {
+		if s.Set == "" || s.DSN == "" && s.Host == "" && s.Socket == "" {
+			return nil, nil, fmt.Errorf("shard %s missing set or server", s.Set)
+		}
+		if target, ok := targets[s.Set]; !ok {
+			targets[s.Set] = s.target()
+			sets = append(sets, s.Set)
+		} else if target != s.target() {
+			return nil, nil, fmt.Errorf("set %s: two servers", s.Set)
+		}
+		ranged := make([]string, Buckets)
+		if err := fillRange(ranged, s.Set, s.HashRange); err != nil {
+			return nil, nil, err
+		}
+		for i, set := range ranged {
+			if set == "" {
+				continue
+			}
+			if hash[i] != "" {
+				return nil, nil, fmt.Errorf("bucket %d in sets %s and %s", i, hash[i], set)
+			}
+			hash[i] = set
+		}
+	}
+	for i, set := range hash {
+		if set == "" {
+			return nil, nil, fmt.Errorf("bucket %d in no set", i)
+		}
+	}
+	return sets, hash, nil
+}
@@ -4,6 +4,7 @@ import (
 	"github.com/ainilili/tdsql-competition/consts"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
 )
 
@@ -13,9 +14,7 @@ type File struct {
 }
 
 func New(path string, flag int) (*File, error) {
-	if !strings.HasPrefix(path, "D") {
-		path = consts.Dir + path
-	}
+	path = Resolve(path)
 	file, err := os.OpenFile(path, flag, os.FileMode(0766))
 	return &File{
 		file: file,
@@ -23,6 +22,14 @@ func New(path string, flag int) (*File, error) {
 	}, err
 }
 
+// Resolve returns the path New opens, relative paths are under consts.Dir.
+func Resolve(path string) string {
+	if !filepath.IsAbs(path) && !strings.HasPrefix(path, "D") {
+		return consts.Dir + path
+	}
+	return path
+}
+
 func (f *File) Seek(offset int64, whence int) (int64, error) {
 	return f.file.Seek(offset, whence)
 }
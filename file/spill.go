@@ -0,0 +1,51 @@
+package file
+
+import (
+	"github.com/ainilili/tdsql-competition/consts"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+var (
+	spillDirs []string
+	spillNext uint32
+)
+
+// SetSpillDirs sets the directories temporary files are spread over.
+func SetSpillDirs(dirs []string) error {
+	abs := make([]string, 0, len(dirs))
+	for _, dir := range dirs {
+		if dir == "" {
+			continue
+		}
+		dir, err := filepath.Abs(dir)
+		if err != nil {
+			return err
+		}
+		err = os.MkdirAll(dir, os.FileMode(0766))
+		if err != nil {
+			return err
+		}
+		abs = append(abs, dir)
+	}
+	spillDirs = abs
+	return nil
+}
+
+// SpillDirs returns the directories of temporary files, consts.Dir by default.
+func SpillDirs() []string {
+	if len(spillDirs) == 0 {
+		return []string{consts.Dir}
+	}
+	return spillDirs
+}
+
+// SpillPath places a new temporary file in the spill directories round robin.
+func SpillPath(name string) string {
+	if len(spillDirs) == 0 {
+		return name
+	}
+	i := atomic.AddUint32(&spillNext, 1) - 1
+	return filepath.Join(spillDirs[int(i)%len(spillDirs)], name)
+}
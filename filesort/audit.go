@@ -0,0 +1,102 @@
+package filesort
+
+import (
+	"fmt"
+	"github.com/ainilili/tdsql-competition/file"
+	"github.com/ainilili/tdsql-competition/log"
+	"github.com/ainilili/tdsql-competition/model"
+	"os"
+	"strings"
+	"sync"
+)
+
+// auditLog records the rows superseded by the conflict policy, one line per
+// conflict: the key, then source, file, offset and deciding values of the
+// winning and of the losing row, tab separated.
+type auditLog struct {
+	sync.Mutex
+	path  string
+	f     *file.File
+	count int
+}
+
+func newAuditLog(table *model.Table) *auditLog {
+	return &auditLog{path: fmt.Sprintf("%d_conflict", table.ID)}
+}
+
+// truncate empties the log for a fresh sort of the table.
+func (a *auditLog) truncate() error {
+	a.Lock()
+	defer a.Unlock()
+	a.close()
+	f, err := file.New(a.path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC|os.O_APPEND)
+	if err != nil {
+		return err
+	}
+	a.f = f
+	a.count = 0
+	return nil
+}
+
+// record appends a conflict, failures are logged as the audit does not
+// decide the rows loaded.
+func (a *auditLog) record(fs *FileSorter, winner, loser *model.Row) {
+	line := strings.Join([]string{
+		winner.Key.String(),
+		fs.describe(winner),
+		fs.describe(loser),
+	}, "\t") + "\n"
+	a.Lock()
+	defer a.Unlock()
+	if a.f == nil {
+		f, err := file.New(a.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND)
+		if err != nil {
+			log.Error(err)
+			return
+		}
+		a.f = f
+	}
+	a.count++
+	_, err := a.f.Write([]byte(line))
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *auditLog) close() {
+	if a.f != nil {
+		_ = a.f.Close()
+		a.f = nil
+	}
+}
+
+// describe renders the source, file, offset and deciding values of a row.
+func (fs *FileSorter) describe(row *model.Row) string {
+	name, path := "", ""
+	if row.Origin < len(fs.table.Sources) {
+		s := fs.table.Sources[row.Origin]
+		name = s.DataSource
+		if s.File != nil {
+			path = s.File.Path()
+		}
+	}
+	decided := ""
+	if d, ok := fs.policy.(Decider); ok {
+		decided = d.Decided(row)
+	}
+	return fmt.Sprintf("%s\t%s\t%d\t%s", name, path, row.Offset, decided)
+}
+
+// resolve applies the conflict policy and audits the superseded row.
+func (fs *FileSorter) resolve(kept, dup *model.Row) *model.Row {
+	winner := fs.policy.Resolve(kept, dup)
+	if fs.audit == nil {
+		return winner
+	}
+	loser := kept
+	if winner.Origin == kept.Origin && winner.Offset == kept.Offset {
+		loser = dup
+	}
+	fs.audit.record(fs, winner, loser)
+	return winner
+}
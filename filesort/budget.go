@@ -0,0 +1,76 @@
+package filesort
+
+import (
+	"github.com/ainilili/tdsql-competition/consts"
+	"sync"
+)
+
+// Memory is the budget shared by the sharding workers of all tables.
+var Memory = NewBudget(consts.MemoryBudget)
+
+// Budget bounds the bytes held by rows waiting to be sorted, Reserve blocks
+// while the budget is exhausted so readers wait for runs to be written.
+type Budget struct {
+	sync.Mutex
+	cond  *sync.Cond
+	limit int64
+	used  int64
+	peak  int64
+}
+
+func NewBudget(limit int64) *Budget {
+	b := &Budget{limit: limit}
+	b.cond = sync.NewCond(&b.Mutex)
+	return b
+}
+
+func (b *Budget) SetLimit(limit int64) {
+	b.Lock()
+	b.limit = limit
+	b.Unlock()
+	b.cond.Broadcast()
+}
+
+// Reserve waits until n bytes are free and returns the reservation, n is
+// capped at the limit so a single worker can always proceed.
+func (b *Budget) Reserve(n int64) int64 {
+	b.Lock()
+	defer b.Unlock()
+	if n > b.limit {
+		n = b.limit
+	}
+	for b.used+n > b.limit {
+		b.cond.Wait()
+	}
+	b.used += n
+	if b.used > b.peak {
+		b.peak = b.used
+	}
+	return n
+}
+
+func (b *Budget) Release(n int64) {
+	b.Lock()
+	b.used -= n
+	b.Unlock()
+	b.cond.Broadcast()
+}
+
+func (b *Budget) Limit() int64 {
+	b.Lock()
+	defer b.Unlock()
+	return b.limit
+}
+
+func (b *Budget) Used() int64 {
+	b.Lock()
+	defer b.Unlock()
+	return b.used
+}
+
+// Peak returns the highest reserved bytes so far.
+func (b *Budget) Peak() int64 {
+	b.Lock()
+	defer b.Unlock()
+	return b.peak
+}
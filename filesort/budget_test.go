@@ -0,0 +1,34 @@
+package filesort
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBudget(t *testing.T) {
+	b := NewBudget(100)
+	if n := b.Reserve(60); n != 60 {
+		t.Fatalf("expect 60, got %d", n)
+	}
+	reserved := make(chan int64)
+	go func() {
+		reserved <- b.Reserve(60)
+	}()
+	select {
+	case <-reserved:
+		t.Fatal("expect reserve to wait for release")
+	case <-time.After(50 * time.Millisecond):
+	}
+	b.Release(60)
+	if n := <-reserved; n != 60 {
+		t.Fatalf("expect 60, got %d", n)
+	}
+	b.Release(60)
+	if n := b.Reserve(200); n != 100 {
+		t.Fatalf("expect reservation capped at 100, got %d", n)
+	}
+	b.Release(100)
+	if b.Used() != 0 || b.Peak() != 100 {
+		t.Fatalf("expect used 0 and peak 100, got %d and %d", b.Used(), b.Peak())
+	}
+}
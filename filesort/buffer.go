@@ -2,14 +2,18 @@ package filesort
 
 import (
 	"bytes"
+	"fmt"
 	"github.com/ainilili/tdsql-competition/consts"
 	"github.com/ainilili/tdsql-competition/file"
 	"github.com/ainilili/tdsql-competition/log"
 	"github.com/ainilili/tdsql-competition/model"
+	"github.com/ainilili/tdsql-competition/util"
 	"io"
-	"strconv"
+	"strings"
 )
 
+var bom = []byte{0xEF, 0xBB, 0xBF}
+
 type buffer struct {
 	buf []byte
 	pos int
@@ -23,44 +27,70 @@ func (bf *buffer) reset() {
 	bf.eof = false
 }
 
+type rejectError struct {
+	path   string
+	offset int64
+	reason string
+	line   string
+}
+
+func (e *rejectError) Error() string {
+	return fmt.Sprintf("%s:%d %s", e.path, e.offset, e.reason)
+}
+
 type fileBuffer struct {
 	buf       *buffer
 	f         *file.File
 	meta      model.Meta
-	tags      map[int]bool
+	dialect   model.Dialect
+	delimiter byte
+	decode    func(src []byte) ([]byte, error)
+	mapping   []int
+	header    bool
+	validate  bool
+	fields    []string
+	builder   *rowBuilder
 	pos       int64
 	lastPos   int64
+	end       int64
 	readTimes int
-	tmp       bytes.Buffer
-	tms       bytes.Buffer
-	tmk       bytes.Buffer
-	upd       int
 }
 
 func newFileBuffer(f *file.File, meta model.Meta) *fileBuffer {
-	cols := meta.PrimaryKeys
-	if len(cols) == 0 {
-		cols = meta.Cols
+	fb, _ := newDialectBuffer(f, meta, model.DefaultDialect())
+	return fb
+}
+
+func newSourceBuffer(s model.Source, meta model.Meta) (*fileBuffer, error) {
+	fb, err := newDialectBuffer(s.File, meta, s.Dialect)
+	if err != nil {
+		return nil, err
 	}
-	tags := map[int]bool{}
-	for _, col := range cols {
-		if col != "updated_at" {
-			tags[meta.ColsIndex[col]] = true
-		}
+	fb.validate = true
+	return fb, nil
+}
+
+func newDialectBuffer(f *file.File, meta model.Meta, dialect model.Dialect) (*fileBuffer, error) {
+	err := dialect.Validate()
+	if err != nil {
+		return nil, err
+	}
+	decode, err := util.Transcoder(dialect.Encoding)
+	if err != nil {
+		return nil, err
 	}
-	upd := meta.ColsIndex["updated_at"]
 	return &fileBuffer{
 		buf: &buffer{
 			buf: make([]byte, consts.FileBufferSize),
 		},
-		f:    f,
-		meta: meta,
-		tags: tags,
-		tmp:  bytes.Buffer{},
-		tms:  bytes.Buffer{},
-		tmk:  bytes.Buffer{},
-		upd:  upd,
-	}
+		f:         f,
+		meta:      meta,
+		dialect:   dialect,
+		delimiter: dialect.Delimiter[0],
+		decode:    decode,
+		header:    dialect.Header,
+		builder:   newRowBuilder(meta),
+	}, nil
 }
 
 func (fb *fileBuffer) Reset(offset int64) {
@@ -71,74 +101,212 @@ func (fb *fileBuffer) Reset(offset int64) {
 	fb.buf.reset()
 	fb.pos = offset
 	fb.lastPos = offset
+	fb.header = offset == 0 && fb.dialect.Header
 }
 
-func (fb *fileBuffer) NextRow() (*model.Row, error) {
-	row := model.Row{}
+// chunk limits the buffer to the lines starting in [start, end), the line
+// crossing start belongs to the previous chunk.
+func (fb *fileBuffer) chunk(start, end int64) error {
+	fb.end = end
+	if start == 0 {
+		fb.Reset(0)
+		return nil
+	}
+	if fb.dialect.Header {
+		fb.Reset(0)
+		err := fb.readHeader()
+		if err != nil {
+			return err
+		}
+	}
+	fb.Reset(start - 1)
+	// only the chunk at 0 starts with the header
+	fb.header = false
+	_, err := fb.readLine()
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+func (fb *fileBuffer) fill() {
 	buf := fb.buf
 	dif := buf.cap - buf.pos
-	if dif < 100 && !buf.eof {
-		copy(buf.buf[:dif], buf.buf[buf.pos:buf.cap])
-		capacity, err := fb.f.Read(buf.buf[dif:])
-		if err != nil {
-			if err == io.EOF {
-				buf.eof = true
-			}
+	if dif == len(buf.buf) {
+		grown := make([]byte, 2*len(buf.buf))
+		copy(grown, buf.buf)
+		buf.buf = grown
+	}
+	copy(buf.buf[:dif], buf.buf[buf.pos:buf.cap])
+	capacity, err := fb.f.Read(buf.buf[dif:])
+	if err != nil {
+		if err != io.EOF {
+			log.Error(err)
 		}
-		fb.readTimes++
-		fb.buf.pos = 0
-		fb.buf.cap = dif + capacity
-	}
-	start := buf.pos
-	index := 0
-	fb.tmk.Reset()
-	fb.tms.Reset()
-	lastPos := fb.pos
-	for ; buf.pos < buf.cap; buf.pos++ {
-		b := buf.buf[buf.pos]
-		fb.pos++
-		if b == consts.LF || b == consts.COMMA {
-			s := string(buf.buf[start:buf.pos])
-			if index == 0 {
-				row.SortID, _ = strconv.Atoi(s)
-			}
-			if fb.tags[index] {
-				fb.tmk.WriteString(s)
-				fb.tmk.WriteByte(',')
-			}
-			t := fb.meta.ColsType[fb.meta.Cols[index]]
-			if t.IsString() && s[0] != '\'' {
-				fb.tms.WriteByte('\'')
-				fb.tms.WriteString(s)
-				fb.tms.WriteByte('\'')
-			} else {
-				fb.tms.WriteString(s)
-			}
-			if b == consts.COMMA {
-				fb.tms.WriteByte(consts.COMMA)
-			}
-			index++
-			start = buf.pos + 1
-			if b == consts.LF {
-				row.Source = fb.tms.String()
-				row.Key = fb.tmk.String()
-				fb.buf.pos++
-				break
+		buf.eof = true
+	}
+	fb.readTimes++
+	buf.pos = 0
+	buf.cap = dif + capacity
+}
+
+// readLine returns the next line without its terminator, the slice is only
+// valid until the next read.
+func (fb *fileBuffer) readLine() ([]byte, error) {
+	buf := fb.buf
+	if fb.end > 0 && fb.pos >= fb.end {
+		return nil, io.EOF
+	}
+	for {
+		if i := bytes.IndexByte(buf.buf[buf.pos:buf.cap], consts.LF); i != -1 {
+			line := buf.buf[buf.pos : buf.pos+i]
+			buf.pos += i + 1
+			fb.pos += int64(i + 1)
+			return line, nil
+		}
+		if buf.eof {
+			if buf.pos == buf.cap {
+				return nil, io.EOF
 			}
+			line := buf.buf[buf.pos:buf.cap]
+			fb.pos += int64(buf.cap - buf.pos)
+			buf.pos = buf.cap
+			return line, nil
 		}
+		fb.fill()
 	}
-	if row.Source == "" {
-		fb.lastPos = fb.pos
-		return nil, io.EOF
+}
+
+func (fb *fileBuffer) readFields() ([]string, error) {
+	var line []byte
+	for len(line) == 0 {
+		lastPos := fb.pos
+		l, err := fb.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if lastPos == 0 && fb.dialect.StripBOM {
+			l = bytes.TrimPrefix(l, bom)
+		}
+		if fb.dialect.CRLF() {
+			l = bytes.TrimSuffix(l, []byte{'\r'})
+		}
+		line = l
+	}
+	if fb.decode != nil {
+		decoded, err := fb.decode(line)
+		if err != nil {
+			return nil, fb.reject(string(line), err.Error())
+		}
+		line = decoded
+	}
+	fb.fields = fb.fields[:0]
+	start := 0
+	for i := 0; i <= len(line); i++ {
+		if i == len(line) || line[i] == fb.delimiter {
+			fb.fields = append(fb.fields, string(line[start:i]))
+			start = i + 1
+		}
+	}
+	return fb.fields, nil
+}
+
+func (fb *fileBuffer) readHeader() error {
+	fb.header = false
+	names, err := fb.readFields()
+	if err != nil {
+		return err
+	}
+	if !fb.dialect.MapByHeader {
+		return nil
+	}
+	mapping := make([]int, len(names))
+	for i, name := range names {
+		name = strings.ToLower(strings.Trim(strings.TrimSpace(name), "`\""))
+		index, ok := fb.meta.ColsIndex[name]
+		if !ok {
+			index = -1
+		}
+		mapping[i] = index
+	}
+	fb.mapping = mapping
+	return nil
+}
+
+// reorder puts the fields of a header-mapped line into schema order, columns
+// missing from the header take their default value.
+func (fb *fileBuffer) reorder(fields []string) []string {
+	cols := make([]string, len(fb.meta.Cols))
+	set := make([]bool, len(cols))
+	for i, field := range fields {
+		if i < len(fb.mapping) && fb.mapping[i] != -1 {
+			cols[fb.mapping[i]] = field
+			set[fb.mapping[i]] = true
+		}
+	}
+	for i, col := range fb.meta.Cols {
+		if !set[i] {
+			cols[i] = fb.meta.DefaultValue[col]
+		}
+	}
+	return cols
+}
+
+func (fb *fileBuffer) NextRow() (*model.Row, error) {
+	if fb.header {
+		err := fb.readHeader()
+		if err != nil {
+			fb.lastPos = fb.pos
+			return nil, err
+		}
+	}
+	fb.lastPos = fb.pos
+	fields, err := fb.readFields()
+	if err != nil {
+		if err == io.EOF {
+			fb.lastPos = fb.pos
+		}
+		return nil, err
+	}
+	if fb.mapping != nil {
+		if fb.validate && len(fields) != len(fb.mapping) {
+			return nil, fb.reject(strings.Join(fields, fb.dialect.Delimiter), fmt.Sprintf("column count %d, expect %d", len(fields), len(fb.mapping)))
+		}
+		fields = fb.reorder(fields)
+	}
+	if fb.validate {
+		err = fb.meta.Validate(fields)
+		if err != nil {
+			return nil, fb.reject(strings.Join(fields, fb.dialect.Delimiter), err.Error())
+		}
+	}
+	row := fb.builder.build(fields)
+	row.Offset = fb.lastPos
+	return row, nil
+}
+
+func (fb *fileBuffer) reject(line, reason string) *rejectError {
+	return &rejectError{
+		path:   fb.f.Path(),
+		offset: fb.lastPos,
+		reason: reason,
+		line:   line,
 	}
-	fb.lastPos = lastPos
-	return &row, nil
 }
 
 func (fb *fileBuffer) Delete() {
 	_ = fb.f.Delete()
 }
 
+func (fb *fileBuffer) SeekTo(position int64) error {
+	fb.Reset(position)
+	return nil
+}
+
+func (fb *fileBuffer) Close() error {
+	return fb.f.Close()
+}
+
 func (fb *fileBuffer) Position() int64 {
 	return fb.pos
 }
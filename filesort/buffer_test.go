@@ -1,12 +1,18 @@
 package filesort
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/ainilili/tdsql-competition/file"
 	"github.com/ainilili/tdsql-competition/log"
 	"github.com/ainilili/tdsql-competition/model"
 	"github.com/ainilili/tdsql-competition/parser"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -36,3 +42,165 @@ func TestFileBuffer(t *testing.T) {
 	fmt.Println(fb.readTimes)
 	fmt.Println((time.Now().UnixNano()-start)/1e6, "ms")
 }
+
+func TestFileBuffer_Dialect(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "1.csv")
+	gbk, _ := simplifiedchinese.GBK.NewEncoder().String("中文")
+	data := "\xEF\xBB\xBFupdated_at\tid\tb\r\n2021-12-12 00:00:00\t1\t" + gbk + "\r\n\r\n2021-12-13 00:00:00\t2\tx\r\n"
+	err := ioutil.WriteFile(path, []byte(data), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := file.New(path, os.O_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sql := "CREATE TABLE if not exists `2` (\n  `id` bigint(20) unsigned NOT NULL,\n  `a` float NOT NULL DEFAULT '0',\n  `b` char(32) NOT NULL DEFAULT '',\n  `updated_at` datetime NOT NULL DEFAULT '2021-12-12 00:00:00',\n  PRIMARY KEY (`id`,`a`)\n) ENGINE=InnoDB DEFAULT CHARSET=utf8"
+	dialect := model.Dialect{
+		Delimiter:      "\t",
+		LineTerminator: "\r\n",
+		Header:         true,
+		MapByHeader:    true,
+		StripBOM:       true,
+		Encoding:       "gbk",
+	}
+	fb, err := newSourceBuffer(model.Source{File: f, Dialect: dialect}, parser.ParseTableMeta(sql))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expects := []string{
+		"1,0,'中文','2021-12-12 00:00:00'",
+		"2,0,'x','2021-12-13 00:00:00'",
+	}
+	for _, expect := range expects {
+		row, err := fb.NextRow()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if row.String() != expect {
+			t.Fatalf("expect %s, got %s", expect, row.String())
+		}
+	}
+	if _, err := fb.NextRow(); err != io.EOF {
+		t.Fatalf("expect eof, got %v", err)
+	}
+}
+
+func TestFileBuffer_Reject(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "1.csv")
+	data := "1,0.5,a,2021-12-12 00:00:00\nx,0.5,b,2021-12-12 00:00:00\n3,0.5,c\n4,0.5,d,2021-13-12 00:00:00\n5,0.5,e,2021-12-12 00:00:00\n"
+	err := ioutil.WriteFile(path, []byte(data), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := file.New(path, os.O_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sql := "CREATE TABLE if not exists `2` (\n  `id` bigint(20) unsigned NOT NULL,\n  `a` float NOT NULL DEFAULT '0',\n  `b` char(32) NOT NULL DEFAULT '',\n  `updated_at` datetime NOT NULL DEFAULT '2021-12-12 00:00:00',\n  PRIMARY KEY (`id`,`a`)\n) ENGINE=InnoDB DEFAULT CHARSET=utf8"
+	fb, err := newSourceBuffer(model.Source{File: f, Dialect: model.DefaultDialect()}, parser.ParseTableMeta(sql))
+	if err != nil {
+		t.Fatal(err)
+	}
+	offsets := []int64{28, 56, 64}
+	ids := make([]string, 0)
+	for {
+		row, err := fb.NextRow()
+		if err == io.EOF {
+			break
+		}
+		if e, ok := err.(*rejectError); ok {
+			if len(offsets) == 0 || e.offset != offsets[0] {
+				t.Fatalf("unexpected reject %v", e)
+			}
+			offsets = offsets[1:]
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, row.ID())
+	}
+	if len(offsets) != 0 || len(ids) != 2 || ids[0] != "1" || ids[1] != "5" {
+		t.Fatalf("unexpected rows %v, missing rejects %v", ids, offsets)
+	}
+}
+
+func TestFileBuffer_Chunk(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "1.csv")
+	data := bytes.Buffer{}
+	data.WriteString("id,a,b,updated_at\n")
+	for i := 0; i < 100; i++ {
+		data.WriteString(fmt.Sprintf("%d,%d.5,%s,2021-12-12 00:00:00\n", i, i, strings.Repeat("x", i%7)))
+	}
+	err := ioutil.WriteFile(path, data.Bytes(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sql := "CREATE TABLE if not exists `2` (\n  `id` bigint(20) unsigned NOT NULL,\n  `a` float NOT NULL DEFAULT '0',\n  `b` char(32) NOT NULL DEFAULT '',\n  `updated_at` datetime NOT NULL DEFAULT '2021-12-12 00:00:00',\n  PRIMARY KEY (`id`,`a`)\n) ENGINE=InnoDB DEFAULT CHARSET=utf8"
+	meta := parser.ParseTableMeta(sql)
+	dialect := model.DefaultDialect()
+	dialect.Header = true
+	for _, chunkSize := range []int64{1, 7, 29, 30, 31, 500, int64(data.Len())} {
+		f, err := file.New(path, os.O_RDONLY)
+		if err != nil {
+			t.Fatal(err)
+		}
+		source, err := newSourceBuffer(model.Source{File: f, Dialect: dialect}, meta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks, err := split(source, chunkSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := map[string]int{}
+		for _, fb := range append([]*fileBuffer{source}, chunks...) {
+			for {
+				row, err := fb.NextRow()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				ids[row.ID()]++
+			}
+			_ = fb.f.Close()
+		}
+		if len(ids) != 100 {
+			t.Fatalf("chunk size %d: expect 100 rows, got %d", chunkSize, len(ids))
+		}
+		for id, n := range ids {
+			if n != 1 {
+				t.Fatalf("chunk size %d: row %s read %d times", chunkSize, id, n)
+			}
+		}
+	}
+	// a chunk starting inside the header reads every line after it as a row
+	f, err := file.New(path, os.O_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fb, err := newSourceBuffer(model.Source{File: f, Dialect: dialect}, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = fb.chunk(1, int64(data.Len())); err != nil {
+		t.Fatal(err)
+	}
+	rows := 0
+	for {
+		if _, err = fb.NextRow(); err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows++
+	}
+	_ = fb.f.Close()
+	if rows != 100 {
+		t.Fatalf("expect 100 rows after the header, got %d", rows)
+	}
+}
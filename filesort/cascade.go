@@ -0,0 +1,144 @@
+package filesort
+
+import (
+	"github.com/ainilili/tdsql-competition/consts"
+	"github.com/ainilili/tdsql-competition/log"
+	"io"
+	"sync"
+)
+
+// MaxFanIn is the most runs a merge reads at once, buckets with more runs
+// are merged in passes before the final merge.
+var MaxFanIn = consts.MaxFanIn
+
+// OpenFiles bounds the shard files held open by all merges.
+var OpenFiles = NewBudget(consts.MaxOpenFiles)
+
+func fanIn() int {
+	n := MaxFanIn
+	if limit := int(OpenFiles.Limit()) - 1; n > limit {
+		n = limit
+	}
+	if n < 2 {
+		n = 2
+	}
+	return n
+}
+
+// cascade merges the runs of every bucket down to a single fan-in.
+func (fs *FileSorter) cascade() error {
+	var cascadeErr error
+	workers := make(chan bool, consts.ShardingLimit)
+	wg := sync.WaitGroup{}
+	for bucket, shards := range fs.shards {
+		if len(shards) <= fanIn() {
+			continue
+		}
+		bucket := bucket
+		wg.Add(1)
+		workers <- true
+		go func() {
+			defer func() {
+				<-workers
+				wg.Add(-1)
+			}()
+			err := fs.cascadeBucket(bucket)
+			if err != nil {
+				log.Error(err)
+				fs.Lock()
+				cascadeErr = err
+				fs.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return cascadeErr
+}
+
+func (fs *FileSorter) cascadeBucket(bucket string) error {
+	fs.Lock()
+	shards := fs.shards[bucket]
+	fs.Unlock()
+	n := fanIn()
+	for pass := 1; len(shards) > n; pass++ {
+		merged := make([]*shard, 0, len(shards)/n+1)
+		for i := 0; i < len(shards); i += n {
+			end := i + n
+			if end > len(shards) {
+				end = len(shards)
+			}
+			if end-i == 1 {
+				merged = append(merged, shards[i])
+				continue
+			}
+			s, err := fs.mergeShards(bucket, shards[i:end])
+			if err != nil {
+				return err
+			}
+			merged = append(merged, s)
+		}
+		log.Infof("table %s bucket %s merge pass %d, %d runs to %d\n", fs.table, bucket, pass, len(shards), len(merged))
+		shards = merged
+	}
+	fs.Lock()
+	fs.shards[bucket] = shards
+	fs.Unlock()
+	return nil
+}
+
+// mergeShards merges runs into a new one and deletes them.
+func (fs *FileSorter) mergeShards(bucket string, shards []*shard) (*shard, error) {
+	files := OpenFiles.Reserve(int64(len(shards) + 1))
+	defer OpenFiles.Release(files)
+	reserved := int64(0)
+	for _, s := range shards {
+		reserved += s.bytes
+	}
+	err := Disk.reserve(fs, reserved)
+	if err != nil {
+		return nil, err
+	}
+	out, err := fs.createShard(bucket)
+	if err != nil {
+		Disk.release(fs, reserved)
+		return nil, err
+	}
+	err = fs.mergeInto(bucket, shards, out)
+	if err != nil {
+		out.Delete()
+		Disk.release(fs, reserved)
+		return nil, err
+	}
+	Disk.release(fs, reserved-out.bytes)
+	out.Reset(0)
+	for _, s := range shards {
+		s.Delete()
+		Disk.release(fs, s.bytes)
+		s.bytes = 0
+	}
+	return out, nil
+}
+
+func (fs *FileSorter) mergeInto(bucket string, shards []*shard, out *shard) error {
+	defer closeShards(shards)
+	lt := fs.newShardMerge(shards)
+	for {
+		row, err := fs.Next(lt, bucket)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		err = out.Write(*row)
+		if err != nil {
+			return err
+		}
+	}
+	err := out.Flush()
+	if err != nil {
+		_ = out.Close()
+		return err
+	}
+	return out.Close()
+}
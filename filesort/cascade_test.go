@@ -0,0 +1,153 @@
+package filesort
+
+import (
+	"fmt"
+	"github.com/ainilili/tdsql-competition/database"
+	"github.com/ainilili/tdsql-competition/model"
+	"github.com/ainilili/tdsql-competition/parser"
+	"io"
+	"os"
+	"testing"
+)
+
+// singleSetDB maps every bucket to one set.
+func singleSetDB(set string) *database.DB {
+	hash := make([]string, database.Buckets)
+	for i := range hash {
+		hash[i] = set
+	}
+	db := &database.DB{}
+	db.SetTopology([]string{set}, hash)
+	return db
+}
+
+// testSorter returns a sorter of a table sharded by hand.
+func testSorter(t *testing.T, table *model.Table) *FileSorter {
+	policy, err := newPolicy(table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := &FileSorter{
+		table:  table,
+		shards: map[string][]*shard{},
+		seq:    map[string]int{},
+		policy: policy,
+	}
+	if err = fs.initPartitioner(); err != nil {
+		t.Fatal(err)
+	}
+	return fs
+}
+
+func TestFileSorter_Cascade(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer func(n, r int) { MaxFanIn, MergeRanges = n, r }(MaxFanIn, MergeRanges)
+	MaxFanIn, MergeRanges = 3, 1
+	meta := parser.ParseTableMeta(testSchema)
+	table := &model.Table{ID: 1, Meta: meta, DB: singleSetDB("s")}
+	fs := testSorter(t, table)
+	rb := newRowBuilder(meta)
+	for run := 0; run < 10; run++ {
+		s, err := fs.newShard("3")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for id := run; id < 20; id += 2 {
+			row := rb.build([]string{fmt.Sprint(id), "0", "b", fmt.Sprintf("2021-12-12 00:00:%02d", run)})
+			if err = s.Write(*row); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err = s.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		_ = s.Close()
+	}
+	if err := fs.cascade(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(fs.shards["3"]); n > MaxFanIn {
+		t.Fatalf("expect at most %d runs, got %d", MaxFanIn, n)
+	}
+	lt := fs.InitLts("s", 0)
+	defer fs.CloseLts(lt)
+	for id := 0; id < 20; id++ {
+		row, err := fs.Next(lt, "s")
+		if err != nil {
+			t.Fatal(err)
+		}
+		latest := id
+		if latest > 9 {
+			latest = 9 - (id+1)%2
+		}
+		expect := rb.build([]string{fmt.Sprint(id), "0", "b", fmt.Sprintf("2021-12-12 00:00:%02d", latest)}).String()
+		if row.String() != expect {
+			t.Fatalf("expect %s, got %s", expect, row.String())
+		}
+	}
+	if _, err := fs.Next(lt, "s"); err != io.EOF {
+		t.Fatalf("expect EOF, got %v", err)
+	}
+}
+
+func TestFileSorter_Buckets(t *testing.T) {
+	defer func(r int) { MergeRanges = r }(MergeRanges)
+	MergeRanges = 1
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	meta := parser.ParseTableMeta(testSchema)
+	db := singleSetDB("a")
+	table := &model.Table{ID: 1, Meta: meta, DB: db}
+	fs := testSorter(t, table)
+	rb := newRowBuilder(meta)
+	for run := 0; run < 3; run++ {
+		rs := map[string]model.Rows{}
+		for id := 0; id < 200; id++ {
+			row := rb.build([]string{fmt.Sprint(id), "0", "b", "2021-12-12 00:00:00"})
+			bucket, err := fs.bucketOf(row)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rs[bucket] = append(rs[bucket], *row)
+		}
+		if err := fs.writeRun(rs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	load := func(set string) int {
+		lt := fs.InitLts(set, 0)
+		defer fs.CloseLts(lt)
+		n := 0
+		for fs.HasNext(lt, set) {
+			if _, err := fs.Next(lt, set); err != nil {
+				t.Fatal(err)
+			}
+			n++
+		}
+		fs.ResetPositions(set, 0, nil)
+		return n
+	}
+	if n := load("a"); n != 200 {
+		t.Fatalf("expect 200 rows, got %d", n)
+	}
+	// the topology splits the set after sharding
+	hash := make([]string, database.Buckets)
+	for i := range hash {
+		hash[i] = "a"
+		if i%2 == 1 {
+			hash[i] = "b"
+		}
+	}
+	db.SetTopology([]string{"a", "b"}, hash)
+	fs.ranges = nil
+	if a, b := load("a"), load("b"); a+b != 200 || a == 0 || b == 0 {
+		t.Fatalf("expect 200 rows over both sets, got %d and %d", a, b)
+	}
+}
@@ -0,0 +1,202 @@
+package filesort
+
+import (
+	"fmt"
+	"github.com/ainilili/tdsql-competition/model"
+	"sync"
+)
+
+// Policy picks the row kept of two rows with the same key. Rows meet in no
+// particular order, so a policy must not depend on which one is kept.
+type Policy interface {
+	Resolve(kept, dup *model.Row) *model.Row
+}
+
+// A Decider is a policy telling the values it compared for a row, written
+// to the conflict audit log.
+type Decider interface {
+	Decided(row *model.Row) string
+}
+
+// PolicyFunc adapts a function to a Policy.
+type PolicyFunc func(kept, dup *model.Row) *model.Row
+
+func (f PolicyFunc) Resolve(kept, dup *model.Row) *model.Row {
+	return f(kept, dup)
+}
+
+// PolicyFactory makes the policy of a table, column is the column the
+// conflict setting of the table names.
+type PolicyFactory func(table *model.Table, column string) (Policy, error)
+
+var (
+	policiesLock = sync.Mutex{}
+	policies     = map[string]PolicyFactory{
+		model.ConflictLatest:   newLatestPolicy,
+		model.ConflictPriority: newPriorityPolicy,
+		model.ConflictFirst:    newFirstPolicy,
+		model.ConflictMerge:    newMergePolicy,
+	}
+)
+
+// RegisterPolicy makes a custom policy available to tables by name.
+func RegisterPolicy(name string, factory PolicyFactory) {
+	policiesLock.Lock()
+	defer policiesLock.Unlock()
+	policies[name] = factory
+}
+
+func newPolicy(table *model.Table) (Policy, error) {
+	name := table.Conflict.Policy
+	if name == "" {
+		name = model.ConflictLatest
+	}
+	policiesLock.Lock()
+	factory, ok := policies[name]
+	policiesLock.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("table %s: unknown conflict policy %s", table, name)
+	}
+	return factory(table, table.Conflict.Column)
+}
+
+// later tells whether a was read after b, by source and then by offset.
+func later(a, b *model.Row) bool {
+	if a.Origin != b.Origin {
+		return a.Origin > b.Origin
+	}
+	return a.Offset > b.Offset
+}
+
+// latestPolicy keeps the row with the greatest value of a timestamp or
+// version column, the row read later on ties.
+type latestPolicy struct {
+	meta  model.Meta
+	col   string
+	index int
+}
+
+func newLatestPolicy(table *model.Table, column string) (Policy, error) {
+	meta := table.Meta
+	if column == "" {
+		if len(meta.Cols) == 0 {
+			return nil, fmt.Errorf("table %s: no columns", table)
+		}
+		column = meta.Cols[len(meta.Cols)-1]
+	}
+	index, ok := meta.ColsIndex[column]
+	if !ok {
+		return nil, fmt.Errorf("table %s: unknown conflict column %s", table, column)
+	}
+	return &latestPolicy{meta: meta, col: column, index: index}, nil
+}
+
+func (p *latestPolicy) value(row *model.Row) model.Value {
+	if p.index >= len(row.Fields) {
+		return model.Value{Source: model.Null}
+	}
+	return p.meta.ParseValue(p.col, row.Fields[p.index])
+}
+
+func (p *latestPolicy) Decided(row *model.Row) string {
+	return p.col + "=" + p.value(row).Source
+}
+
+func (p *latestPolicy) Resolve(kept, dup *model.Row) *model.Row {
+	c := p.value(dup).Compare(p.value(kept))
+	if c > 0 || c == 0 && later(dup, kept) {
+		return dup
+	}
+	return kept
+}
+
+// priorityPolicy keeps the row of the source with the higher priority, the
+// latest row of equal priorities.
+type priorityPolicy struct {
+	sources []model.Source
+	latest  *latestPolicy
+}
+
+func newPriorityPolicy(table *model.Table, column string) (Policy, error) {
+	latest, err := newLatestPolicy(table, column)
+	if err != nil {
+		return nil, err
+	}
+	return &priorityPolicy{sources: table.Sources, latest: latest.(*latestPolicy)}, nil
+}
+
+func (p *priorityPolicy) priority(row *model.Row) int {
+	if row.Origin < len(p.sources) {
+		return p.sources[row.Origin].Priority
+	}
+	return 0
+}
+
+func (p *priorityPolicy) Decided(row *model.Row) string {
+	return fmt.Sprintf("priority=%d,%s", p.priority(row), p.latest.Decided(row))
+}
+
+func (p *priorityPolicy) Resolve(kept, dup *model.Row) *model.Row {
+	a, b := p.priority(kept), p.priority(dup)
+	switch {
+	case b > a:
+		return dup
+	case b < a:
+		return kept
+	}
+	return p.latest.Resolve(kept, dup)
+}
+
+// newFirstPolicy keeps the row read first.
+func newFirstPolicy(*model.Table, string) (Policy, error) {
+	return PolicyFunc(func(kept, dup *model.Row) *model.Row {
+		if later(kept, dup) {
+			return dup
+		}
+		return kept
+	}), nil
+}
+
+// mergePolicy keeps the latest row with its NULL fields taken from the other.
+type mergePolicy struct {
+	latest *latestPolicy
+	// builder renders merged rows, shared by the merges of the table.
+	builder     *rowBuilder
+	builderLock sync.Mutex
+}
+
+func newMergePolicy(table *model.Table, column string) (Policy, error) {
+	latest, err := newLatestPolicy(table, column)
+	if err != nil {
+		return nil, err
+	}
+	return &mergePolicy{latest: latest.(*latestPolicy), builder: newRowBuilder(table.Meta)}, nil
+}
+
+func (p *mergePolicy) Decided(row *model.Row) string {
+	return p.latest.Decided(row)
+}
+
+func (p *mergePolicy) Resolve(kept, dup *model.Row) *model.Row {
+	winner, loser := kept, dup
+	if p.latest.Resolve(kept, dup) == dup {
+		winner, loser = dup, kept
+	}
+	var fields []string
+	for i, field := range winner.Fields {
+		if field == model.Null && i < len(loser.Fields) && loser.Fields[i] != model.Null {
+			if fields == nil {
+				fields = append([]string{}, winner.Fields...)
+			}
+			fields[i] = loser.Fields[i]
+		}
+	}
+	if fields == nil {
+		return winner
+	}
+	p.builderLock.Lock()
+	row := p.builder.build(fields)
+	p.builderLock.Unlock()
+	row.Origin, row.Offset = winner.Origin, winner.Offset
+	return row
+}
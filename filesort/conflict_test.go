@@ -0,0 +1,111 @@
+package filesort
+
+import (
+	"github.com/ainilili/tdsql-competition/file"
+	"github.com/ainilili/tdsql-competition/model"
+	"github.com/ainilili/tdsql-competition/parser"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestPolicy(t *testing.T) {
+	schema := "CREATE TABLE if not exists `t` (\n  `id` bigint(20) NOT NULL,\n  `a` char(8) DEFAULT NULL,\n  `version` int(11) NOT NULL,\n  `updated_at` datetime NOT NULL,\n  PRIMARY KEY (`id`)\n) ENGINE=InnoDB DEFAULT CHARSET=utf8"
+	table := &model.Table{
+		Name:    "t",
+		Meta:    parser.ParseTableMeta(schema),
+		Sources: []model.Source{{Priority: 2}, {Priority: 1}},
+	}
+	rb := newRowBuilder(table.Meta)
+	row := func(origin int, offset int64, fields ...string) *model.Row {
+		r := rb.build(fields)
+		r.Origin, r.Offset = origin, offset
+		return r
+	}
+	a := row(0, 10, "1", "x", "9", "2021-12-12 00:00:01")
+	b := row(1, 5, "1", model.Null, "10", "2021-12-12 00:00:01")
+	cases := []struct {
+		conflict model.Conflict
+		expect   string
+	}{
+		{model.Conflict{}, b.String()},
+		{model.Conflict{Policy: model.ConflictLatest, Column: "version"}, b.String()},
+		{model.Conflict{Policy: model.ConflictPriority}, a.String()},
+		{model.Conflict{Policy: model.ConflictFirst}, a.String()},
+		{model.Conflict{Policy: model.ConflictMerge, Column: "version"}, "1,'x',10,'2021-12-12 00:00:01'"},
+	}
+	for _, c := range cases {
+		table.Conflict = c.conflict
+		p, err := newPolicy(table)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range [][2]*model.Row{{a, b}, {b, a}} {
+			if got := p.Resolve(r[0], r[1]).String(); got != c.expect {
+				t.Errorf("%v: expect %s, got %s", c.conflict, c.expect, got)
+			}
+		}
+	}
+	RegisterPolicy("smallest", func(*model.Table, string) (Policy, error) {
+		return PolicyFunc(func(kept, dup *model.Row) *model.Row {
+			if dup.Fields[2] < kept.Fields[2] {
+				return dup
+			}
+			return kept
+		}), nil
+	})
+	table.Conflict = model.Conflict{Policy: "smallest"}
+	p, err := newPolicy(table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := p.Resolve(a, b); got != b {
+		t.Errorf("expect %s, got %s", b, got)
+	}
+	for _, c := range []model.Conflict{{Policy: "none"}, {Column: "none"}} {
+		table.Conflict = c
+		if _, err := newPolicy(table); err == nil {
+			t.Errorf("%v: expect error", c)
+		}
+	}
+}
+
+func TestFileSorter_Audit(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	meta := parser.ParseTableMeta(testSchema)
+	table := &model.Table{
+		ID:       1,
+		Meta:     meta,
+		Sources:  []model.Source{{DataSource: "src_a"}, {DataSource: "src_b"}},
+		Conflict: model.Conflict{Policy: model.ConflictPriority},
+		Audit:    true,
+	}
+	policy, err := newPolicy(table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := &FileSorter{table: table, policy: policy, audit: newAuditLog(table)}
+	if err := fs.audit.truncate(); err != nil {
+		t.Fatal(err)
+	}
+	rb := newRowBuilder(meta)
+	a := rb.build([]string{"1", "0", "a", "2021-12-12 00:00:02"})
+	b := rb.build([]string{"1", "0", "b", "2021-12-12 00:00:01"})
+	b.Origin, b.Offset = 1, 42
+	if got := fs.resolve(b, a); got != a {
+		t.Fatalf("expect %s, got %s", a, got)
+	}
+	fs.Close()
+	data, err := ioutil.ReadFile(file.Resolve(fs.audit.path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := "1,0\tsrc_a\t\t0\tpriority=0,updated_at=2021-12-12 00:00:02\tsrc_b\t\t42\tpriority=0,updated_at=2021-12-12 00:00:01\n"
+	if string(data) != expect {
+		t.Errorf("expect %q, got %q", expect, data)
+	}
+}
@@ -0,0 +1,153 @@
+package filesort
+
+import (
+	"fmt"
+	"github.com/ainilili/tdsql-competition/consts"
+	"github.com/ainilili/tdsql-competition/file"
+	"github.com/ainilili/tdsql-competition/log"
+	"github.com/ainilili/tdsql-competition/model"
+	"github.com/ainilili/tdsql-competition/util"
+	"sync"
+)
+
+// Disk bounds the bytes of shard files of all tables, no limit when not positive.
+var Disk = newDiskQuota(consts.DiskQuota)
+
+// diskQuota pauses sharding while the shards on disk exceed the limit. Only
+// tables done sharding free space as their sets load, so a table waits while
+// they hold some and fails when it alone exceeds the limit.
+type diskQuota struct {
+	sync.Mutex
+	cond  *sync.Cond
+	limit int64
+	total int64
+	used  map[*FileSorter]int64
+}
+
+func newDiskQuota(limit int64) *diskQuota {
+	q := &diskQuota{
+		limit: limit,
+		used:  map[*FileSorter]int64{},
+	}
+	q.cond = sync.NewCond(&q.Mutex)
+	return q
+}
+
+func (q *diskQuota) SetLimit(limit int64) {
+	q.Lock()
+	q.limit = limit
+	q.Unlock()
+	q.cond.Broadcast()
+}
+
+func (q *diskQuota) Used() int64 {
+	q.Lock()
+	defer q.Unlock()
+	return q.total
+}
+
+func (q *diskQuota) reserve(fs *FileSorter, n int64) error {
+	q.Lock()
+	defer q.Unlock()
+	for q.limit > 0 && q.total+n > q.limit {
+		freeing := false
+		for other, used := range q.used {
+			if other != fs && other.sharded && used > 0 {
+				freeing = true
+				break
+			}
+		}
+		if !freeing {
+			return fmt.Errorf("table %s needs %dMB of shards, exceeds disk quota %dMB", fs.table, (q.used[fs]+n)/consts.M, q.limit/consts.M)
+		}
+		q.cond.Wait()
+	}
+	q.total += n
+	q.used[fs] += n
+	return nil
+}
+
+func (q *diskQuota) markSharded(fs *FileSorter) {
+	q.Lock()
+	fs.sharded = true
+	q.Unlock()
+	q.cond.Broadcast()
+}
+
+// release returns bytes to the quota, negative n records bytes beyond a reservation.
+func (q *diskQuota) release(fs *FileSorter, n int64) {
+	q.Lock()
+	q.total -= n
+	q.used[fs] -= n
+	if q.used[fs] == 0 {
+		delete(q.used, fs)
+	}
+	q.Unlock()
+	q.cond.Broadcast()
+}
+
+// DeleteShards removes the shard files of the buckets of a set once it is loaded.
+func (fs *FileSorter) DeleteShards(set string) {
+	for _, bucket := range fs.buckets(set) {
+		fs.deleteShards(bucket)
+	}
+}
+
+func (fs *FileSorter) deleteShards(bucket string) {
+	shards := fs.bucketShards(bucket)
+	for _, s := range shards {
+		s.Delete()
+		Disk.release(fs, s.bytes)
+		s.bytes = 0
+	}
+}
+
+// Preflight compares the shards the tables need against the free space of
+// the spill directories and the quota. Shards take about the size of the
+// sources and a merge pass copies a table once more, so the largest table
+// doubled must fit, all tables fitting at once only avoids waiting on loads.
+func Preflight(tables []*model.Table) error {
+	total, largest := int64(0), int64(0)
+	for _, t := range tables {
+		size := int64(0)
+		for _, s := range t.Sources {
+			size += s.File.Size()
+		}
+		total += size
+		if size > largest {
+			largest = size
+		}
+	}
+	// directories on one file system share its free space
+	free := uint64(0)
+	devices := map[string]bool{}
+	for _, dir := range file.SpillDirs() {
+		dev, err := util.Device(dir)
+		if err != nil {
+			return fmt.Errorf("disk space check of %s: %v", dir, err)
+		}
+		if devices[dev] {
+			continue
+		}
+		devices[dev] = true
+		n, err := util.FreeSpace(dir)
+		if err != nil {
+			return fmt.Errorf("disk space check of %s: %v", dir, err)
+		}
+		free += n
+	}
+	capacity := int64(free)
+	Disk.Lock()
+	if Disk.limit > 0 && Disk.limit < capacity {
+		capacity = Disk.limit
+	}
+	Disk.Unlock()
+	log.Infof("shards need about %dMB, largest table %dMB, %dMB available\n", total/consts.M, largest/consts.M, capacity/consts.M)
+	if 2*largest > capacity {
+		return fmt.Errorf("largest table needs about %dMB of shards, only %dMB available", 2*largest/consts.M, capacity/consts.M)
+	}
+	if total > capacity {
+		log.Infof("shards of all tables exceed the available space, sharding will wait for tables to load\n")
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package filesort
+
+import (
+	"github.com/ainilili/tdsql-competition/file"
+	"github.com/ainilili/tdsql-competition/model"
+	"github.com/ainilili/tdsql-competition/util"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDiskQuota(t *testing.T) {
+	q := newDiskQuota(100)
+	loading := &FileSorter{table: &model.Table{Name: "loading"}}
+	sharding := &FileSorter{table: &model.Table{Name: "sharding"}}
+	if err := q.reserve(sharding, 80); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.reserve(sharding, 40); err == nil {
+		t.Fatal("expect quota exceeded while no loaded table can free space")
+	}
+	q.release(sharding, 80)
+
+	if err := q.reserve(loading, 80); err != nil {
+		t.Fatal(err)
+	}
+	q.markSharded(loading)
+	reserved := make(chan error)
+	go func() {
+		reserved <- q.reserve(sharding, 40)
+	}()
+	select {
+	case err := <-reserved:
+		t.Fatalf("expect reserve to wait for the loading table, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	q.release(loading, 80)
+	if err := <-reserved; err != nil {
+		t.Fatal(err)
+	}
+	if q.Used() != 40 {
+		t.Fatalf("expect 40 used, got %d", q.Used())
+	}
+}
+
+func TestPreflight(t *testing.T) {
+	defer file.SetSpillDirs(nil)
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+	if err := file.SetSpillDirs([]string{a, b}); err != nil {
+		t.Fatal(err)
+	}
+	da, _ := util.Device(a)
+	db, _ := util.Device(b)
+	if da == "" || da != db {
+		t.Fatalf("expect dirs of one file system to share a device, got %q %q", da, db)
+	}
+	if err := Preflight(nil); err != nil {
+		t.Fatal(err)
+	}
+	// a directory that cannot be checked fails instead of skipping the check
+	if err := os.Remove(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := Preflight(nil); err == nil {
+		t.Fatal("expect a missing spill dir to fail")
+	}
+}
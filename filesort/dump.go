@@ -0,0 +1,109 @@
+package filesort
+
+import (
+	"fmt"
+	"github.com/ainilili/tdsql-competition/model"
+	"github.com/ainilili/tdsql-competition/parser"
+	"io"
+	"strings"
+)
+
+// dumpSource reads the rows a mysqldump file inserts into one table.
+type dumpSource struct {
+	s       model.Source
+	scanner *parser.DumpScanner
+	meta    model.Meta
+	builder *rowBuilder
+}
+
+func newDumpSource(s model.Source, meta model.Meta) (*dumpSource, error) {
+	ds := &dumpSource{
+		s:       s,
+		scanner: parser.NewDumpScanner(s.File),
+		meta:    meta,
+		builder: newRowBuilder(meta),
+	}
+	err := ds.SeekTo(0)
+	if err != nil {
+		return nil, err
+	}
+	return ds, nil
+}
+
+func (ds *dumpSource) NextRow() (*model.Row, error) {
+	pos := ds.scanner.Position()
+	values, err := ds.scanner.NextRow(ds.s.Table)
+	if err != nil {
+		return nil, err
+	}
+	nulls := ds.scanner.Nulls()
+	var fields []string
+	if columns := ds.scanner.Columns(); columns != nil {
+		named := make(map[string]string, len(columns))
+		for i, col := range columns {
+			if i < len(values) && !nulls[i] {
+				named[col] = values[i]
+			}
+		}
+		fields = byName(ds.meta, named)
+		for i, col := range columns {
+			if index, ok := ds.meta.ColsIndex[col]; ok && i < len(values) && nulls[i] {
+				fields[index] = model.Null
+			}
+		}
+	} else {
+		fields = make([]string, len(values))
+		for i, v := range values {
+			if nulls[i] {
+				fields[i] = model.Null
+			} else if i < len(ds.meta.Cols) {
+				fields[i] = decoded(ds.meta.ColsType[ds.meta.Cols[i]], v)
+			} else {
+				fields[i] = v
+			}
+		}
+	}
+	err = ds.meta.Validate(fields)
+	if err != nil {
+		return nil, &rejectError{
+			path:   ds.s.File.Path(),
+			offset: pos,
+			reason: err.Error(),
+			line:   strings.Join(values, ","),
+		}
+	}
+	row := ds.builder.build(fields)
+	row.Offset = pos
+	return row, nil
+}
+
+func (ds *dumpSource) Position() int64 {
+	return ds.scanner.Position()
+}
+
+// SeekTo scans the file again up to the position, so that the rows after it
+// are read with the column list of the INSERT they belong to.
+func (ds *dumpSource) SeekTo(position int64) error {
+	_, err := ds.s.File.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	ds.scanner.Reset(ds.s.File)
+	for ds.scanner.Position() < position {
+		_, err = ds.scanner.NextRow(ds.s.Table)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if ds.scanner.Position() != position {
+		return fmt.Errorf("%s: %d is no row position", ds.s.File.Path(), position)
+	}
+	return nil
+}
+
+func (ds *dumpSource) Close() error {
+	return ds.s.File.Close()
+}
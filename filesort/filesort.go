@@ -6,66 +6,100 @@ import (
 	"github.com/ainilili/tdsql-competition/consts"
 	"github.com/ainilili/tdsql-competition/file"
 	"github.com/ainilili/tdsql-competition/log"
+	"github.com/ainilili/tdsql-competition/merge"
 	"github.com/ainilili/tdsql-competition/model"
+	"github.com/ainilili/tdsql-competition/partition"
 	"github.com/ainilili/tdsql-competition/util"
 	"io"
 	"os"
-	"sort"
+	"strconv"
 	"strings"
 	"sync"
 )
 
+// FileSorter sorts the rows of a table into shards per hash bucket, the
+// topology maps buckets to sets when they are loaded.
 type FileSorter struct {
 	sync.Mutex
-	sources []*fileBuffer
-	shards  map[string][]*fileBuffer
-	table   *model.Table
+	sources    []Source
+	shards     map[string][]*shard
+	table      *model.Table
+	rejects    int
+	rejectFile *file.File
+	seq        map[string]int
+	policy     Policy
+	audit      *auditLog
+	// partitioner routes rows to buckets by their shard key and buckets
+	// to sets.
+	partitioner partition.Partitioner
+	shardKey    int
+	// owners pins the set of every bucket once sharded, routes are the
+	// live sets of the buckets, moved tells the sets with buckets owned by
+	// another set now and epochs counts the route changes of each set.
+	owners []string
+	routes []string
+	moved  map[string]bool
+	epochs map[string]int
+	// mode is the dedup mode of the table, in hash mode the shards of a
+	// bucket are its partitions, partFiles the open files reserved for
+	// them while sharding, and counts the rows the load of a set returned
+	// of each.
+	mode       string
+	partitions int
+	partFiles  int64
+	parts      map[string][]*part
+	counts     map[string][]int64
+	ranges     map[string]*setRanges
+	rangesLock sync.Mutex
+	// splitters are the range splitters of each set saved with the shards.
+	splitters map[string][]model.Key
+	// sharded is set once the shards are complete, guarded by Disk.
+	sharded bool
 }
 
-type shardLoserValue struct {
-	shard *fileBuffer
-	l     *loser
-	row   *model.Row
+// setMerge merges the shards of a set, rows with equal keys are resolved
+// by the conflict policy of the table.
+type setMerge struct {
+	m     rowStream
+	err   error
+	close func()
 }
 
-func (sv *shardLoserValue) next() error {
-	row, err := sv.shard.NextRow()
-	if err != nil {
-		return err
-	}
-	sv.row = row
-	return nil
+type rowStream interface {
+	Next() (interface{}, error)
+	HasNext() bool
 }
 
-func (sv *shardLoserValue) Compare(o interface{}) bool {
-	ov := o.(*shardLoserValue)
-	cur := sv.row
-	next := ov.row
-	if cur.Key != next.Key {
-		return cur.Compare(*next)
-	}
-	if next.UpdateAt() > cur.UpdateAt() {
-		sv.row = next
-	}
-	err := ov.next()
-	if err != nil {
-		ov.row = nil
-		ov.l.exit()
-		return false
-	}
-	ov.l.contest()
-	return sv.Compare(ov)
+func compareRows(a, b interface{}) int {
+	return a.(*model.Row).Key.Compare(b.(*model.Row).Key)
 }
 
 func New(table *model.Table) (*FileSorter, error) {
-	sources := make([]*fileBuffer, len(table.Sources))
+	sources := make([]Source, len(table.Sources))
 	for i, s := range table.Sources {
-		sources[i] = newFileBuffer(s.File, table.Meta)
+		source, err := newSource(s, table.Meta)
+		if err != nil {
+			return nil, err
+		}
+		sources[i] = source
 	}
-	return &FileSorter{
+	policy, err := newPolicy(table)
+	if err != nil {
+		return nil, err
+	}
+	fs := &FileSorter{
 		sources: sources,
 		table:   table,
-	}, nil
+		policy:  policy,
+	}
+	err = fs.initPartitioner()
+	if err != nil {
+		return nil, err
+	}
+	if table.Audit {
+		fs.audit = newAuditLog(table)
+	}
+	return fs, nil
 }
 
 func Recover(table *model.Table, path string) (*FileSorter, error) {
@@ -73,206 +107,696 @@ func Recover(table *model.Table, path string) (*FileSorter, error) {
 }
 
 func recoverFileSort(table *model.Table, path string) (*FileSorter, error) {
-	shards := map[string][]*fileBuffer{}
-	setInfos := strings.Split(path, ";")
-	for _, setInfo := range setInfos {
-		infos := strings.Split(setInfo, ":")
-		set := infos[0]
-		files := strings.Split(infos[1], ",")
-		s := make([]*fileBuffer, 0)
-		for _, fp := range files {
-			f, err := file.New(fp, os.O_RDWR)
+	policy, err := newPolicy(table)
+	if err != nil {
+		return nil, err
+	}
+	mode := model.DedupSort
+	if strings.HasPrefix(path, model.DedupHash+";") {
+		mode = model.DedupHash
+		path = path[len(mode)+1:]
+	}
+	shards := map[string][]*shard{}
+	owners := map[string]string{}
+	splitters := map[string][]model.Key{}
+	bucketInfos := strings.Split(path, ";")
+	for _, bucketInfo := range bucketInfos {
+		if strings.HasPrefix(bucketInfo, rangesPrefix) {
+			set, keys, err := parseSplitters(table.Meta, bucketInfo)
 			if err != nil {
 				return nil, err
 			}
-			s = append(s, newFileBuffer(f, table.Meta))
+			splitters[set] = keys
+			continue
+		}
+		infos := strings.Split(bucketInfo, ":")
+		bucket := infos[0]
+		if i := strings.IndexByte(bucket, '@'); i != -1 {
+			owners[bucket[:i]] = bucket[i+1:]
+			bucket = bucket[:i]
 		}
-		shards[set] = s
+		files := strings.Split(infos[1], ",")
+		s := make([]*shard, 0)
+		for _, fp := range files {
+			shard := openShard(fp, table.Meta)
+			if info, err := os.Stat(file.Resolve(fp)); err == nil {
+				shard.bytes = info.Size()
+			}
+			s = append(s, shard)
+		}
+		shards[bucket] = s
 	}
 	fs := &FileSorter{
-		shards: shards,
-		table:  table,
+		shards:    shards,
+		table:     table,
+		seq:       map[string]int{},
+		policy:    policy,
+		mode:      mode,
+		counts:    map[string][]int64{},
+		splitters: splitters,
+	}
+	err = fs.initPartitioner()
+	if err != nil {
+		return nil, err
+	}
+	fs.pin(owners)
+	if table.Audit {
+		fs.audit = newAuditLog(table)
 	}
+	for _, ss := range shards {
+		for _, s := range ss {
+			Disk.release(fs, -s.bytes)
+		}
+	}
+	Disk.markSharded(fs)
 	return fs, nil
 }
 
-func (fs *FileSorter) InitLts(set string) *loserTree {
-	losers := make([]*loser, 0)
-	for _, shard := range fs.shards[set] {
-		l := &loser{}
-		sv := &shardLoserValue{
-			shard: shard,
-			l:     l,
+// InitLts starts the final merge of range r of a set, it holds the shard
+// files of a bucket of the set open until the bucket is merged or CloseLts.
+func (fs *FileSorter) InitLts(set string, r int) *setMerge {
+	if fs.mode == model.DedupHash {
+		return fs.newHashDedup(set)
+	}
+	sr, err := fs.setRanges(set)
+	if err != nil {
+		return &setMerge{err: err}
+	}
+	b := &bucketMerge{fs: fs, groups: sr.readers[r]}
+	b.lo, b.hi = sr.bounds(r)
+	width := 0
+	for _, shards := range b.groups {
+		if len(shards) > width {
+			width = len(shards)
 		}
-		l.value = sv
-		err := sv.next()
-		if err != nil {
-			continue
+	}
+	files := OpenFiles.Reserve(int64(width))
+	return &setMerge{m: b, close: func() {
+		for _, shards := range b.groups {
+			closeShards(shards)
+		}
+		OpenFiles.Release(files)
+	}}
+}
+
+func (fs *FileSorter) CloseLts(lt *setMerge) {
+	if lt.close != nil {
+		lt.close()
+		lt.close = nil
+	}
+}
+
+func (fs *FileSorter) newShardMerge(shards []*shard) *setMerge {
+	m, err := fs.newMerger(shards, nil, nil)
+	return &setMerge{m: m, err: err}
+}
+
+// newMerger merges the rows of the shards from lo up to hi, nil bounds are open.
+func (fs *FileSorter) newMerger(shards []*shard, lo, hi model.Key) (*merge.Merger, error) {
+	its := make([]merge.Iterator, len(shards))
+	for i := range shards {
+		s := shards[i]
+		if lo != nil && s.Position() == 0 {
+			err := s.seek(lo)
+			if err != nil {
+				return nil, err
+			}
+		}
+		its[i] = merge.IteratorFunc(func() (interface{}, error) {
+			for {
+				row, err := s.NextRow()
+				if err != nil {
+					return nil, err
+				}
+				if lo != nil && row.Key.Compare(lo) < 0 {
+					continue
+				}
+				if hi != nil && row.Key.Compare(hi) >= 0 {
+					return nil, io.EOF
+				}
+				return row, nil
+			}
+		})
+	}
+	return merge.New(its, compareRows, func(kept, dup interface{}) interface{} {
+		return fs.resolve(kept.(*model.Row), dup.(*model.Row))
+	})
+}
+
+// bucketMerge merges the buckets of a set one after another, buckets share
+// no keys so rows of different buckets never need to meet.
+type bucketMerge struct {
+	fs     *FileSorter
+	groups [][]*shard
+	lo, hi model.Key
+	i      int
+	cur    *merge.Merger
+	err    error
+}
+
+func (b *bucketMerge) advance() {
+	for b.err == nil && (b.cur == nil || !b.cur.HasNext()) && b.i < len(b.groups) {
+		if b.i > 0 {
+			closeShards(b.groups[b.i-1])
 		}
-		losers = append(losers, l)
+		b.cur, b.err = b.fs.newMerger(b.groups[b.i], b.lo, b.hi)
+		b.i++
+	}
+}
+
+// HasNext reports a failed merge as pending so that Next returns its error.
+func (b *bucketMerge) HasNext() bool {
+	b.advance()
+	return b.err != nil || b.cur != nil && b.cur.HasNext()
+}
+
+func (b *bucketMerge) Next() (interface{}, error) {
+	b.advance()
+	if b.err != nil {
+		return nil, b.err
+	}
+	if b.cur == nil {
+		return nil, io.EOF
+	}
+	item, err := b.cur.Next()
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	return item, err
+}
+
+func closeShards(shards []*shard) {
+	for _, shard := range shards {
+		_ = shard.Close()
 	}
-	return newLoserTree(losers)
 }
 
 func (fs *FileSorter) Table() *model.Table {
 	return fs.table
 }
 
-func (fs *FileSorter) Shards() map[string][]*fileBuffer {
+// Shards returns the shards of every bucket.
+func (fs *FileSorter) Shards() map[string][]*shard {
 	return fs.shards
 }
 
-func (fs *FileSorter) newShard(set string) (*fileBuffer, error) {
+func (fs *FileSorter) initPartitioner() error {
+	p, err := partition.New(fs.table)
+	if err != nil {
+		return err
+	}
+	err = partition.Validate(p, fs.table.DB)
+	if err != nil {
+		return err
+	}
+	fs.partitioner = p
+	fs.shardKey = fs.table.Meta.ColsIndex[fs.table.ShardKey()]
+	return nil
+}
+
+// Sets returns the sets loading the table, the sets of the partitioner and
+// those pinned to buckets that since moved away.
+func (fs *FileSorter) Sets() []string {
+	sets := append([]string{}, fs.partitioner.Sets()...)
 	fs.Lock()
 	defer fs.Unlock()
-	f, err := file.New(fmt.Sprintf("%d_shard_%s_%d", fs.table.ID, set, len(fs.shards[set])), os.O_CREATE|os.O_RDWR|os.O_TRUNC)
+	for _, set := range fs.owners {
+		if set != "" && util.IndexOf(sets, set) == -1 {
+			sets = append(sets, set)
+		}
+	}
+	return sets
+}
+
+// buckets returns the buckets with shards pinned to a set, or the
+// partitioner maps to it before they are pinned.
+func (fs *FileSorter) buckets(set string) []string {
+	sets := make([]string, fs.partitioner.Buckets())
+	for i := range sets {
+		sets[i] = fs.partitioner.Set(i)
+	}
+	fs.Lock()
+	defer fs.Unlock()
+	buckets := make([]string, 0)
+	for i, s := range sets {
+		if i < len(fs.owners) && fs.owners[i] != "" {
+			s = fs.owners[i]
+		}
+		bucket := strconv.Itoa(i)
+		if s == set && len(fs.shards[bucket]) > 0 {
+			buckets = append(buckets, bucket)
+		}
+	}
+	return buckets
+}
+
+func (fs *FileSorter) bucketShards(bucket string) []*shard {
+	fs.Lock()
+	defer fs.Unlock()
+	return fs.shards[bucket]
+}
+
+// SetShards returns the shards of the buckets of a set in bucket order.
+func (fs *FileSorter) SetShards(set string) []*shard {
+	shards := make([]*shard, 0)
+	for _, bucket := range fs.buckets(set) {
+		shards = append(shards, fs.bucketShards(bucket)...)
+	}
+	return shards
+}
+
+// bucketOf returns the bucket the partitioner puts a row in by its shard key.
+func (fs *FileSorter) bucketOf(row *model.Row) (string, error) {
+	field := model.Null
+	if fs.shardKey < len(row.Fields) {
+		field = row.Fields[fs.shardKey]
+	}
+	b, err := fs.partitioner.Bucket(fs.table.Meta.ParseValue(fs.table.ShardKey(), field))
+	if err != nil {
+		return "", err
+	}
+	return strconv.Itoa(b), nil
+}
+
+func (fs *FileSorter) newShard(bucket string) (*shard, error) {
+	shard, err := fs.createShard(bucket)
 	if err != nil {
 		return nil, err
 	}
-	shard := newFileBuffer(f, fs.table.Meta)
-	fs.shards[set] = append(fs.shards[set], shard)
+	fs.appendShard(bucket, shard)
 	return shard, nil
 }
 
-func (fs *FileSorter) appendShard(set string, shard *fileBuffer) {
+// createShard creates an empty shard file of the bucket.
+func (fs *FileSorter) createShard(bucket string) (*shard, error) {
+	fs.Lock()
+	seq := fs.seq[bucket]
+	fs.seq[bucket]++
+	fs.Unlock()
+	f, err := file.New(file.SpillPath(fmt.Sprintf("%d_shard_%s_%d", fs.table.ID, bucket, seq)), os.O_CREATE|os.O_RDWR|os.O_TRUNC)
+	if err != nil {
+		return nil, err
+	}
+	return newShard(f, fs.table.Meta), nil
+}
+
+func (fs *FileSorter) appendShard(set string, shard *shard) {
 	fs.Lock()
 	defer fs.Unlock()
 	fs.shards[set] = append(fs.shards[set], shard)
 }
 
 func (fs *FileSorter) Sharding() error {
-	shards := map[string][]*fileBuffer{}
+	shards := map[string][]*shard{}
 	fs.shards = shards
+	fs.seq = map[string]int{}
+	fs.counts = map[string][]int64{}
+	fs.ranges = nil
+	fs.splitters = nil
+	fs.owners = nil
+	fs.mode, fs.partitions = plan(fs.table, fs.partitioner.Buckets())
+	if fs.mode == model.DedupHash {
+		fs.parts = map[string][]*part{}
+		log.Infof("table %s dedup by hash in %d partitions per set\n", fs.table, fs.partitions)
+	}
+	if fs.audit != nil {
+		err := fs.audit.truncate()
+		if err != nil {
+			return err
+		}
+	}
+	chunks := make([]Source, len(fs.sources))
+	copy(chunks, fs.sources)
+	origins := make([]int, len(fs.sources))
+	for i := range origins {
+		origins[i] = i
+	}
+	for i, source := range fs.sources {
+		fb, ok := source.(*fileBuffer)
+		if !ok {
+			continue
+		}
+		cs, err := split(fb, consts.FileChunkSize)
+		if err != nil {
+			return err
+		}
+		for _, c := range cs {
+			chunks = append(chunks, c)
+			origins = append(origins, i)
+		}
+	}
+	var shardingErr error
+	workers := make(chan bool, consts.ShardingLimit)
 	wg := sync.WaitGroup{}
-	wg.Add(len(fs.sources))
-	for i := 0; i < len(fs.sources); i++ {
-		source := fs.sources[i]
+	wg.Add(len(chunks))
+	for i := 0; i < len(chunks); i++ {
+		chunk, origin := chunks[i], origins[i]
+		workers <- true
 		go func() {
-			defer wg.Add(-1)
-			err := fs.shardingSource(source)
+			defer func() {
+				<-workers
+				wg.Add(-1)
+			}()
+			err := fs.shardingSource(chunk, origin)
 			if err != nil {
 				log.Error(err)
+				fs.Lock()
+				shardingErr = err
+				fs.Unlock()
 			}
 		}()
 	}
 	wg.Wait()
+	if fs.mode == model.DedupHash {
+		err := fs.closePartitions()
+		if err != nil && shardingErr == nil {
+			shardingErr = err
+		}
+	}
+	for _, chunk := range chunks[len(fs.sources):] {
+		_ = chunk.Close()
+	}
+	log.Infof("table %s sharded, memory peak %dMB of %dMB\n", fs.table, Memory.Peak()/consts.M, Memory.Limit()/consts.M)
+	if fs.rejectFile != nil {
+		log.Infof("table %s rejected %d rows, see %s\n", fs.table, fs.rejects, fs.rejectFile.Path())
+		_ = fs.rejectFile.Close()
+	}
+	if fs.audit != nil {
+		log.Infof("table %s superseded %d rows while sharding, see %s\n", fs.table, fs.audit.count, file.Resolve(fs.audit.path))
+	}
+	if shardingErr == nil && fs.mode == model.DedupSort {
+		shardingErr = fs.cascade()
+	}
+	if shardingErr != nil {
+		for bucket := range fs.shards {
+			fs.deleteShards(bucket)
+		}
+		return shardingErr
+	}
+	Disk.markSharded(fs)
+	fs.pin(nil)
 	path := bytes.Buffer{}
-	for set, shards := range fs.shards {
-		path.WriteString(set + ":")
+	if fs.mode == model.DedupHash {
+		path.WriteString(fs.mode + ";")
+	}
+	for bucket, shards := range fs.shards {
+		path.WriteString(bucket + "@" + fs.owner(bucket) + ":")
 		for _, s := range shards {
-			path.WriteString(s.f.Path() + ",")
+			path.WriteString(s.Path() + ",")
 		}
 		path.Truncate(path.Len() - 1)
 		path.WriteString(";")
 	}
-	path.Truncate(path.Len() - 1)
+	if fs.mode == model.DedupSort {
+		for _, set := range fs.Sets() {
+			sr, err := fs.setRanges(set)
+			if err != nil {
+				return err
+			}
+			path.WriteString(formatSplitters(set, sr.splitters) + ";")
+		}
+	}
+	if path.Len() > 0 {
+		path.Truncate(path.Len() - 1)
+	}
 	return fs.table.Recover.Make(1, path.String())
 }
 
-func (fs *FileSorter) shardingSource(source *fileBuffer) error {
-	var lastPos int64
-	buf := bytes.Buffer{}
-	rows := map[string]model.Rows{}
-	rowsChan := make(chan map[string]model.Rows, 2)
+// split limits the source to its first chunk and returns buffers over its
+// other chunks, each reading the file through its own handle.
+func split(source *fileBuffer, chunkSize int64) ([]*fileBuffer, error) {
+	size := source.f.Size()
+	if size <= chunkSize {
+		return nil, nil
+	}
+	err := source.chunk(0, chunkSize)
+	if err != nil {
+		return nil, err
+	}
+	chunks := make([]*fileBuffer, 0, size/chunkSize)
+	for start := chunkSize; start < size; start += chunkSize {
+		f, err := file.New(source.f.Path(), os.O_RDONLY)
+		if err != nil {
+			return nil, err
+		}
+		chunk, err := newDialectBuffer(f, source.meta, source.dialect)
+		if err != nil {
+			return nil, err
+		}
+		chunk.validate = source.validate
+		err = chunk.chunk(start, start+chunkSize)
+		if err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, chunk)
+	}
+	return chunks, nil
+}
+
+// reject records an invalid source row in the reject file of the table and
+// fails once the table exceeds its max rejects, negative means no limit.
+func (fs *FileSorter) reject(e *rejectError) error {
+	fs.Lock()
+	defer fs.Unlock()
+	if fs.rejectFile == nil {
+		f, err := file.New(fmt.Sprintf("%d_reject", fs.table.ID), os.O_CREATE|os.O_RDWR|os.O_TRUNC)
+		if err != nil {
+			return err
+		}
+		fs.rejectFile = f
+	}
+	fs.rejects++
+	_, err := fs.rejectFile.Write([]byte(fmt.Sprintf("%s\t%d\t%s\t%s\n", e.path, e.offset, e.reason, e.line)))
+	if err != nil {
+		return err
+	}
+	if fs.table.MaxRejects >= 0 && fs.rejects > fs.table.MaxRejects {
+		return fmt.Errorf("table %s rejected %d rows, exceeds max rejects %d", fs.table, fs.rejects, fs.table.MaxRejects)
+	}
+	return nil
+}
+
+// unrouted rejects a row the partitioner has no partition for.
+func (fs *FileSorter) unrouted(row *model.Row, err error) *rejectError {
+	path := ""
+	if row.Origin < len(fs.table.Sources) && fs.table.Sources[row.Origin].File != nil {
+		path = fs.table.Sources[row.Origin].File.Path()
+	}
+	return &rejectError{path: path, offset: row.Offset, reason: err.Error(), line: row.Source}
+}
+
+// run is a batch of rows read under a reservation of the memory budget.
+type run struct {
+	rows     map[string]model.Rows
+	reserved int64
+}
+
+func (fs *FileSorter) shardingSource(source Source, origin int) error {
+	runChan := make(chan *run, 2)
+	done := make(chan bool)
+	defer func() {
+		close(done)
+		for r := range runChan {
+			if r != nil {
+				Memory.Release(r.reserved)
+			}
+		}
+	}()
+	var readErr error
 	go func() {
+		defer close(runChan)
+		size := int64(0)
+		r := &run{rows: map[string]model.Rows{}, reserved: Memory.Reserve(consts.FileSortShardSize)}
 		for {
 			row, nextErr := source.NextRow()
+			if e, ok := nextErr.(*rejectError); ok {
+				nextErr = fs.reject(e)
+				if nextErr == nil {
+					continue
+				}
+			}
+			if nextErr != nil && nextErr != io.EOF {
+				readErr = nextErr
+			}
 			if row != nil {
-				set := fs.table.DB.Hash()[util.MurmurHash2([]byte(row.ID()), 2773)%64]
-				rows[set] = append(rows[set], *row)
+				row.Origin = origin
+				bucket, err := fs.bucketOf(row)
+				if err == nil {
+					r.rows[bucket] = append(r.rows[bucket], *row)
+					size += int64(row.Size())
+				} else if err = fs.reject(fs.unrouted(row, err)); err != nil && nextErr == nil {
+					nextErr, readErr = err, err
+				}
 			}
-			if source.pos-lastPos > consts.FileSortShardSize || nextErr != nil {
-				lastPos = source.pos
-				rowsChan <- rows
+			if size >= r.reserved || nextErr != nil {
+				select {
+				case runChan <- r:
+				case <-done:
+					Memory.Release(r.reserved)
+					return
+				}
 				if nextErr != nil {
-					rowsChan <- nil
-					break
+					select {
+					case runChan <- nil:
+					case <-done:
+					}
+					return
 				}
-				rows = map[string]model.Rows{}
+				size = 0
+				r = &run{rows: map[string]model.Rows{}, reserved: Memory.Reserve(consts.FileSortShardSize)}
 			}
 		}
 	}()
-	for {
-		select {
-		case rows := <-rowsChan:
-			if rows == nil {
-				return nil
-			}
-			for set, rs := range rows {
-				sort.Sort(&rs)
-				shard, err := fs.newShard(set)
-				if err != nil {
-					return err
-				}
-				l := rs.Len()
-				for i := 0; i < l; i++ {
-					cur := rs[i]
-					for j := i + 1; j < l; j++ {
-						next := rs[j]
-						if cur.Key != next.Key {
-							i = j - 1
-							break
-						}
-						i = j
-						if next.UpdateAt() > cur.UpdateAt() {
-							cur = next
-						}
-					}
-					buf.WriteString(cur.String() + "\n")
-				}
-				_, err = shard.f.Write(buf.Bytes())
-				if err != nil {
-					return err
-				}
-				shard.Reset(0)
-				buf.Reset()
+	for r := range runChan {
+		if r == nil {
+			return readErr
+		}
+		err := fs.writeRun(r.rows)
+		Memory.Release(r.reserved)
+		if err != nil {
+			return err
+		}
+	}
+	return readErr
+}
+
+// writeRun sorts the rows of each bucket and writes them deduplicated to a
+// new shard, in hash mode it appends them to the partitions of the buckets.
+func (fs *FileSorter) writeRun(rows map[string]model.Rows) error {
+	if fs.mode == model.DedupHash {
+		return fs.writePartitions(rows)
+	}
+	orders := sortRuns(rows)
+	for bucket, rs := range rows {
+		err := fs.writeBucket(bucket, rs, orders[bucket])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeBucket writes the rows of a bucket in order to a new shard, reserving their
+// size in the disk quota until the shard size is known.
+func (fs *FileSorter) writeBucket(bucket string, rs model.Rows, order []int32) error {
+	estimate := int64(0)
+	for i := range rs {
+		estimate += int64(len(rs[i].Source))
+	}
+	err := Disk.reserve(fs, estimate)
+	if err != nil {
+		return err
+	}
+	shard, err := fs.newShard(bucket)
+	if err != nil {
+		Disk.release(fs, estimate)
+		return err
+	}
+	defer func() {
+		Disk.release(fs, estimate-shard.bytes)
+	}()
+	l := len(order)
+	for i := 0; i < l; i++ {
+		cur := &rs[order[i]]
+		for j := i + 1; j < l; j++ {
+			next := &rs[order[j]]
+			if cur.Key.Compare(next.Key) != 0 {
+				i = j - 1
+				break
 			}
+			i = j
+			cur = fs.resolve(cur, next)
 		}
+		err = shard.Write(*cur)
+		if err != nil {
+			_ = shard.Close()
+			return err
+		}
+	}
+	err = shard.Flush()
+	if err != nil {
+		_ = shard.Close()
+		return err
+	}
+	err = shard.Close()
+	if err != nil {
+		return err
 	}
+	shard.Reset(0)
+	return nil
 }
 
-func (fs *FileSorter) Next(lt *loserTree, set string) (*model.Row, error) {
-	if !fs.HasNext(lt, set) {
-		return nil, io.EOF
+// Next returns the smallest row of the set, a shard failing to read fails
+// the merge rather than ending it early.
+func (fs *FileSorter) Next(lt *setMerge, set string) (*model.Row, error) {
+	if lt.err != nil {
+		return nil, lt.err
 	}
-	l := lt.root()
-	v := l.value.(*shardLoserValue)
-	row := v.row
-	err := v.next()
+	row, err := lt.m.Next()
 	if err != nil {
-		l.exit()
-	} else {
-		l.contest()
+		return nil, err
 	}
-	return row, nil
+	return row.(*model.Row), nil
 }
 
-func (fs *FileSorter) HasNext(lt *loserTree, set string) bool {
-	return !(len(lt.losers) == 0 || lt.root() == nil || lt.root().invalid)
+func (fs *FileSorter) HasNext(lt *setMerge, set string) bool {
+	return lt.err == nil && lt.m.HasNext()
 }
 
-func (fs *FileSorter) LastPositions(set string) []int64 {
-	shards := fs.shards[set]
-	positions := make([]int64, len(shards))
-	for i, s := range shards {
-		positions[i] = s.LastPosition()
+// LastPositions returns the positions range r of the set resumes from by
+// the paths of its shards.
+func (fs *FileSorter) LastPositions(set string, r int) map[string]int64 {
+	shards := fs.rangeShards(set, r)
+	positions := make(map[string]int64, len(shards))
+	if fs.mode == model.DedupHash {
+		fs.Lock()
+		defer fs.Unlock()
+		counts := fs.counts[set]
+		for i, s := range shards {
+			positions[s.Path()] = 0
+			if i < len(counts) {
+				positions[s.Path()] = counts[i]
+			}
+		}
+		return positions
+	}
+	for _, s := range shards {
+		positions[s.Path()] = s.LastPosition()
 	}
 	return positions
 }
 
-func (fs *FileSorter) ResetPositions(set string, positions []int64) {
-	shards := fs.shards[set]
-	for i, s := range shards {
-		if positions[i] > 0 {
-			s.Reset(positions[i])
+// ResetPositions resumes range r of the set from positions by shard path,
+// an empty checkpoint starts every shard from the beginning.
+func (fs *FileSorter) ResetPositions(set string, r int, positions map[string]int64) {
+	shards := fs.rangeShards(set, r)
+	for _, s := range shards {
+		if _, ok := positions[s.Path()]; !ok && len(positions) > 0 {
+			log.Errorf("table %s_%s checkpoint without shard %s, merging it from the start\n", fs.table, set, s.Path())
 		}
 	}
+	if fs.mode == model.DedupHash {
+		counts := make([]int64, len(shards))
+		for i, s := range shards {
+			counts[i] = positions[s.Path()]
+		}
+		fs.Lock()
+		defer fs.Unlock()
+		fs.counts[set] = counts
+		return
+	}
+	for _, s := range shards {
+		s.Reset(positions[s.Path()])
+	}
 }
 
 func (fs *FileSorter) Close() {
+	if fs.audit != nil {
+		fs.audit.close()
+	}
 	if len(fs.sources) > 0 {
 		for _, s := range fs.sources {
-			_ = s.f.Close()
+			_ = s.Close()
 		}
 	}
 }
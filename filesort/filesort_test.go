@@ -12,7 +12,7 @@ import (
 )
 
 func TestFileSorter_Sharding(t *testing.T) {
-	db, _ := database.New("tdsqlshard-n756r9nq.sql.tencentcdb.com", 113, "nico", "Niconico2021@")
+	db, _ := database.New(database.Config{Host: "tdsqlshard-n756r9nq.sql.tencentcdb.com", Port: 113, User: "nico", Password: "Niconico2021@"})
 	tables, err := parser.ParseTables(db, "D:\\workspace-tencent\\data1")
 	if err != nil {
 		t.Fatal(err)
@@ -54,7 +54,7 @@ func TestSort(t *testing.T) {
 	for i := 0; i < 40000*6; i++ {
 		k := rand.Intn(1000000000)
 		rows = append(rows, model.Row{
-			SortID: k,
+			Key: model.Key{{Type: model.Bigint, Value: int64(k)}},
 		})
 		id = append(id, SortSlice{
 			id: k,
@@ -68,3 +68,58 @@ func TestSort(t *testing.T) {
 	sort.Sort(id)
 	fmt.Println((time.Now().UnixNano() - s) / 1e6)
 }
+
+func randomRows(n int, str bool) model.Rows {
+	meta := model.Meta{ColsType: map[string]model.Type{"id": model.Bigint, "b": model.Char}}
+	rows := make(model.Rows, n)
+	for i := range rows {
+		k := rand.Int63n(1<<40) - 1<<39
+		if str {
+			rows[i].Key = model.Key{meta.ParseValue("b", fmt.Sprintf("k%x", k)), meta.ParseValue("id", fmt.Sprint(i%7))}
+		} else {
+			rows[i].Key = model.Key{meta.ParseValue("id", fmt.Sprint(k)), meta.ParseValue("id", fmt.Sprint(i%7))}
+		}
+	}
+	return rows
+}
+
+func TestSortRun(t *testing.T) {
+	for _, n := range []int{0, 1, 1000, parallelSortSize * 3} {
+		for _, str := range []bool{false, true} {
+			rows := randomRows(n, str)
+			order := sortRun(rows)
+			sorted := append(model.Rows{}, rows...)
+			sort.Sort(sorted)
+			for i, index := range order {
+				if rows[index].Key.Compare(sorted[i].Key) != 0 {
+					t.Fatalf("n %d: row %d expect %v, got %v", n, i, sorted[i].Key, rows[index].Key)
+				}
+			}
+		}
+	}
+}
+
+func BenchmarkSortRows(b *testing.B) {
+	rows := randomRows(240000, false)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rs := append(model.Rows{}, rows...)
+		sort.Sort(rs)
+	}
+}
+
+func BenchmarkSortRun(b *testing.B) {
+	rows := randomRows(240000, false)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sortRun(rows)
+	}
+}
+
+func BenchmarkSortRun_String(b *testing.B) {
+	rows := randomRows(240000, true)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sortRun(rows)
+	}
+}
@@ -0,0 +1,326 @@
+package filesort
+
+import (
+	"github.com/ainilili/tdsql-competition/consts"
+	"github.com/ainilili/tdsql-competition/log"
+	"github.com/ainilili/tdsql-competition/model"
+	"github.com/shopspring/decimal"
+	"hash/fnv"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// hashExpansion estimates the bytes a row holds in memory per byte of
+	// its source or shard.
+	hashExpansion = 4
+	maxPartitions = 256
+)
+
+// plan picks how a table is deduplicated and the partitions of each bucket
+// in hash mode: sort mode when its rows fit the memory budget, its runs merge
+// in a single pass or its partitions could not fit the memory budget, hash
+// mode otherwise.
+func plan(table *model.Table, buckets int) (string, int) {
+	n, fits := partitionCount(table, buckets)
+	switch table.Dedup {
+	case model.DedupSort, model.DedupHash:
+		return table.Dedup, n
+	}
+	estimate := sourceSize(table) * hashExpansion
+	runs := (estimate + consts.FileSortShardSize - 1) / consts.FileSortShardSize
+	if estimate <= Memory.Limit() || runs <= int64(fanIn()) {
+		return model.DedupSort, n
+	}
+	if !fits {
+		log.Infof("table %s partitions would not fit %dMB of memory, dedup by sort\n", table, Memory.Limit()/consts.M)
+		return model.DedupSort, n
+	}
+	return model.DedupHash, n
+}
+
+func sourceSize(table *model.Table) int64 {
+	size := int64(0)
+	for _, s := range table.Sources {
+		if s.File != nil {
+			size += s.File.Size()
+		}
+	}
+	return size
+}
+
+// partitionCount returns the partitions of each bucket so that one read whole
+// fits in a sharding run and in the memory budget, and whether that many fit
+// the open files and maxPartitions, the count is capped otherwise.
+func partitionCount(table *model.Table, buckets int) (int, bool) {
+	size := int64(consts.FileSortShardSize)
+	if limit := Memory.Limit(); limit < size {
+		size = limit
+	}
+	n := (sourceSize(table)*hashExpansion/int64(buckets) + size - 1) / size
+	if n < 1 {
+		n = 1
+	}
+	limit := OpenFiles.Limit() / int64(buckets)
+	if limit > maxPartitions {
+		limit = maxPartitions
+	}
+	if limit < 1 {
+		limit = 1
+	}
+	if n > limit {
+		return int(limit), false
+	}
+	return int(n), true
+}
+
+// hashKey renders a key so that keys comparing equal render the same.
+func hashKey(k model.Key) string {
+	b := strings.Builder{}
+	for _, v := range k {
+		var s string
+		switch a := v.Value.(type) {
+		case nil:
+			s = "n" + v.Source
+		case int64:
+			if a >= 0 {
+				s = "u" + strconv.FormatUint(uint64(a), 10)
+			} else {
+				s = "i" + strconv.FormatInt(a, 10)
+			}
+		case uint64:
+			s = "u" + strconv.FormatUint(a, 10)
+		case float64:
+			if a == 0 {
+				a = 0
+			}
+			s = "f" + strconv.FormatUint(math.Float64bits(a), 16)
+		case decimal.Decimal:
+			s = "d" + a.String()
+		case time.Time:
+			s = "t" + strconv.FormatInt(a.UnixNano(), 10)
+		case string:
+			s = "s" + a
+		default:
+			s = "x" + v.Source
+		}
+		b.WriteString(strconv.Itoa(len(s)))
+		b.WriteByte(':')
+		b.WriteString(s)
+	}
+	return b.String()
+}
+
+func keyPartition(k model.Key, parts int) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(hashKey(k)))
+	return int(h.Sum32() % uint32(parts))
+}
+
+// part is a shard of a bucket the sharding workers append to in turn.
+type part struct {
+	sync.Mutex
+	s *shard
+}
+
+// writePartitions appends the rows of a run unsorted to the partitions of
+// their buckets, duplicates are left to the load.
+func (fs *FileSorter) writePartitions(rows map[string]model.Rows) error {
+	fs.Lock()
+	if fs.partFiles == 0 {
+		// the partitions of every bucket stay open until closePartitions
+		fs.partFiles = OpenFiles.Reserve(int64(fs.partitions * fs.partitioner.Buckets()))
+	}
+	fs.Unlock()
+	for bucket, rs := range rows {
+		fs.Lock()
+		parts, ok := fs.parts[bucket]
+		if !ok {
+			parts = make([]*part, fs.partitions)
+			for i := range parts {
+				parts[i] = &part{}
+			}
+			fs.parts[bucket] = parts
+		}
+		fs.Unlock()
+		byPart := make([][]int, len(parts))
+		estimate := int64(0)
+		for i := range rs {
+			p := keyPartition(rs[i].Key, len(parts))
+			byPart[p] = append(byPart[p], i)
+			estimate += int64(len(rs[i].Source))
+		}
+		err := Disk.reserve(fs, estimate)
+		if err != nil {
+			return err
+		}
+		written := int64(0)
+		for p, indexes := range byPart {
+			if len(indexes) == 0 {
+				continue
+			}
+			n, err := fs.appendPartition(bucket, parts[p], rs, indexes)
+			written += n
+			if err != nil {
+				Disk.release(fs, estimate-written)
+				return err
+			}
+		}
+		Disk.release(fs, estimate-written)
+	}
+	return nil
+}
+
+func (fs *FileSorter) appendPartition(bucket string, p *part, rs model.Rows, indexes []int) (int64, error) {
+	p.Lock()
+	defer p.Unlock()
+	if p.s == nil {
+		s, err := fs.newShard(bucket)
+		if err != nil {
+			return 0, err
+		}
+		p.s = s
+	}
+	before := p.s.bytes
+	for _, i := range indexes {
+		err := p.s.Write(rs[i])
+		if err != nil {
+			return p.s.bytes - before, err
+		}
+	}
+	return p.s.bytes - before, nil
+}
+
+// closePartitions flushes the partitions once all workers are done.
+func (fs *FileSorter) closePartitions() error {
+	var closeErr error
+	for _, parts := range fs.parts {
+		for _, p := range parts {
+			if p.s == nil {
+				continue
+			}
+			before := p.s.bytes
+			err := p.s.Flush()
+			Disk.release(fs, before-p.s.bytes)
+			if err == nil {
+				err = p.s.Close()
+			}
+			if err != nil {
+				_ = p.s.Close()
+				closeErr = err
+			}
+			p.s.Reset(0)
+		}
+	}
+	fs.parts = nil
+	OpenFiles.Release(fs.partFiles)
+	fs.partFiles = 0
+	return closeErr
+}
+
+// hashDedup streams the rows of a set partition by partition, each read
+// whole and deduplicated in a map. Rows keep the order of their first
+// occurrence, so counts of the rows returned per partition resume the stream.
+type hashDedup struct {
+	fs       *FileSorter
+	shards   []*shard
+	counts   []int64
+	part     int
+	cur      int
+	rows     []*model.Row
+	next     int
+	reserved int64
+	err      error
+}
+
+func (h *hashDedup) load(i int) error {
+	s := h.shards[i]
+	defer s.Close()
+	h.release()
+	h.reserved = Memory.Reserve(s.bytes * hashExpansion)
+	s.Reset(0)
+	index := map[string]int{}
+	rows := make([]*model.Row, 0)
+	for {
+		row, err := s.NextRow()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		key := hashKey(row.Key)
+		if j, ok := index[key]; ok {
+			rows[j] = h.fs.resolve(rows[j], row)
+			continue
+		}
+		index[key] = len(rows)
+		rows = append(rows, row)
+	}
+	h.cur = i
+	h.rows = rows
+	h.next = int(h.counts[i])
+	if h.next > len(rows) {
+		h.next = len(rows)
+	}
+	return nil
+}
+
+// advance loads partitions until one has rows left.
+func (h *hashDedup) advance() {
+	for h.err == nil && h.next == len(h.rows) && h.part < len(h.shards) {
+		h.err = h.load(h.part)
+		h.part++
+	}
+}
+
+// HasNext reports a failed load as pending so that Next returns its error.
+func (h *hashDedup) HasNext() bool {
+	h.advance()
+	return h.err != nil || h.next < len(h.rows)
+}
+
+func (h *hashDedup) Next() (interface{}, error) {
+	h.advance()
+	if h.err != nil {
+		return nil, h.err
+	}
+	if h.next == len(h.rows) {
+		return nil, io.EOF
+	}
+	row := h.rows[h.next]
+	h.next++
+	h.fs.Lock()
+	h.counts[h.cur] = int64(h.next)
+	h.fs.Unlock()
+	return row, nil
+}
+
+func (h *hashDedup) release() {
+	Memory.Release(h.reserved)
+	h.reserved = 0
+	h.rows = nil
+}
+
+func (fs *FileSorter) newHashDedup(set string) *setMerge {
+	shards := fs.SetShards(set)
+	fs.Lock()
+	counts, ok := fs.counts[set]
+	if !ok || len(counts) != len(shards) {
+		counts = make([]int64, len(shards))
+		fs.counts[set] = counts
+	}
+	fs.Unlock()
+	h := &hashDedup{fs: fs, shards: shards, counts: counts}
+	files := OpenFiles.Reserve(1)
+	log.Infof("table %s_%s hash dedup of %d partitions\n", fs.table, set, len(h.shards))
+	return &setMerge{m: h, close: func() {
+		h.release()
+		closeShards(h.shards)
+		OpenFiles.Release(files)
+	}}
+}
@@ -0,0 +1,133 @@
+package filesort
+
+import (
+	"fmt"
+	"github.com/ainilili/tdsql-competition/consts"
+	"github.com/ainilili/tdsql-competition/file"
+	"github.com/ainilili/tdsql-competition/model"
+	"github.com/ainilili/tdsql-competition/parser"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func TestHashKey(t *testing.T) {
+	meta := parser.ParseTableMeta(testSchema)
+	rb := newRowBuilder(meta)
+	key := func(fields ...string) string {
+		return hashKey(rb.build(append(fields, "2021-12-12 00:00:00")).Key)
+	}
+	if key("1", "0", "a") != key("1", "-0", "b") || key("1", "1.50", "a") != key("1", "1.5", "a") {
+		t.Error("expect equal keys to hash the same")
+	}
+	if key("1", "0", "a") == key("10", "0", "a") || key("1", "0", "a") == key("1", model.Null, "a") {
+		t.Error("expect different keys to hash apart")
+	}
+}
+
+func TestPlan(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "1.csv")
+	if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, 1<<30); err != nil {
+		t.Fatal(err)
+	}
+	f, err := file.New(path, os.O_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	table := &model.Table{Meta: parser.ParseTableMeta(testSchema), Sources: []model.Source{{File: f}}}
+	defer Memory.SetLimit(Memory.Limit())
+	// 4GB of rows in 64 buckets of 64MB, 4 partitions of 16MB each
+	Memory.SetLimit(64 * consts.M)
+	if mode, n := plan(table, 64); mode != model.DedupHash || n != 4 {
+		t.Fatalf("expect hash mode in 4 partitions, got %s in %d", mode, n)
+	}
+	// partitions of 1MB are 64 per bucket, more than 1024 open files allow
+	Memory.SetLimit(consts.M)
+	if mode, n := plan(table, 64); mode != model.DedupSort || n != 16 {
+		t.Fatalf("expect sort mode, got %s in %d partitions", mode, n)
+	}
+	table.Dedup = model.DedupHash
+	if mode, n := plan(table, 64); mode != model.DedupHash || n != 16 {
+		t.Fatalf("expect forced hash mode in 16 partitions, got %s in %d", mode, n)
+	}
+}
+
+func TestFileSorter_Hash(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	meta := parser.ParseTableMeta(testSchema)
+	table := &model.Table{ID: 1, Meta: meta, DB: singleSetDB("s")}
+	fs := testSorter(t, table)
+	fs.mode, fs.partitions = model.DedupHash, 3
+	fs.parts, fs.counts = map[string][]*part{}, map[string][]int64{}
+	rb := newRowBuilder(meta)
+	expects := map[string]string{}
+	for run := 0; run < 4; run++ {
+		rs := map[string]model.Rows{}
+		for id := run; id < 50; id += 2 {
+			row := rb.build([]string{fmt.Sprint(id), "0", "b", fmt.Sprintf("2021-12-12 00:00:%02d", run)})
+			bucket, err := fs.bucketOf(row)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rs[bucket] = append(rs[bucket], *row)
+			expects[fmt.Sprint(id)] = row.String()
+		}
+		if err := fs.writeRun(rs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := OpenFiles.Used(); n != int64(3*fs.partitioner.Buckets()) {
+		t.Fatalf("expect the partitions of every bucket reserved, got %d files", n)
+	}
+	if err := fs.closePartitions(); err != nil {
+		t.Fatal(err)
+	}
+	if n := OpenFiles.Used(); n != 0 {
+		t.Fatalf("expect the partition files released, got %d", n)
+	}
+	for bucket, shards := range fs.shards {
+		if len(shards) > 3 {
+			t.Fatalf("expect at most 3 partitions of bucket %s, got %d", bucket, len(shards))
+		}
+	}
+	read := func(limit int) []string {
+		lt := fs.InitLts("s", 0)
+		defer fs.CloseLts(lt)
+		rows := make([]string, 0)
+		for len(rows) != limit && fs.HasNext(lt, "s") {
+			row, err := fs.Next(lt, "s")
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			rows = append(rows, row.String())
+		}
+		return rows
+	}
+	rows := read(20)
+	positions := fs.LastPositions("s", 0)
+	fs.ResetPositions("s", 0, positions)
+	rows = append(rows, read(-1)...)
+	expect := make([]string, 0, len(expects))
+	for _, row := range expects {
+		expect = append(expect, row)
+	}
+	sort.Strings(rows)
+	sort.Strings(expect)
+	if fmt.Sprint(rows) != fmt.Sprint(expect) {
+		t.Errorf("expect %v, got %v", expect, rows)
+	}
+}
@@ -0,0 +1,98 @@
+package filesort
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/ainilili/tdsql-competition/model"
+	"io"
+	"strings"
+)
+
+// jsonLinesSource reads one json object per line, keys are matched to the
+// columns by name.
+type jsonLinesSource struct {
+	lines   *fileBuffer
+	meta    model.Meta
+	builder *rowBuilder
+}
+
+func newJSONLinesSource(s model.Source, meta model.Meta) (*jsonLinesSource, error) {
+	lines, err := newDialectBuffer(s.File, meta, model.DefaultDialect())
+	if err != nil {
+		return nil, err
+	}
+	return &jsonLinesSource{
+		lines:   lines,
+		meta:    meta,
+		builder: newRowBuilder(meta),
+	}, nil
+}
+
+func (js *jsonLinesSource) NextRow() (*model.Row, error) {
+	lb := js.lines
+	var line []byte
+	for len(line) == 0 {
+		lb.lastPos = lb.pos
+		l, err := lb.readLine()
+		if err != nil {
+			if err == io.EOF {
+				lb.lastPos = lb.pos
+			}
+			return nil, err
+		}
+		if lb.lastPos == 0 {
+			l = bytes.TrimPrefix(l, bom)
+		}
+		line = bytes.TrimSpace(l)
+	}
+	obj := map[string]interface{}{}
+	decoder := json.NewDecoder(bytes.NewReader(line))
+	decoder.UseNumber()
+	err := decoder.Decode(&obj)
+	if err != nil {
+		return nil, lb.reject(string(line), err.Error())
+	}
+	values := make(map[string]string, len(obj))
+	for k, v := range obj {
+		if v == nil {
+			continue
+		}
+		values[strings.ToLower(k)] = jsonString(v)
+	}
+	fields := byName(js.meta, values)
+	err = js.meta.Validate(fields)
+	if err != nil {
+		return nil, lb.reject(string(line), err.Error())
+	}
+	row := js.builder.build(fields)
+	row.Offset = lb.lastPos
+	return row, nil
+}
+
+func jsonString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		if v {
+			return "1"
+		}
+		return "0"
+	}
+	bs, _ := json.Marshal(v)
+	return string(bs)
+}
+
+func (js *jsonLinesSource) Position() int64 {
+	return js.lines.Position()
+}
+
+func (js *jsonLinesSource) SeekTo(position int64) error {
+	return js.lines.SeekTo(position)
+}
+
+func (js *jsonLinesSource) Close() error {
+	return js.lines.Close()
+}
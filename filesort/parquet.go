@@ -0,0 +1,216 @@
+package filesort
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ainilili/tdsql-competition/file"
+	"github.com/ainilili/tdsql-competition/model"
+	"github.com/shopspring/decimal"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/reader"
+	"github.com/xitongsys/parquet-go/source"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const parquetBatch = 1024
+
+// parquetFile adapts file.File to the parquet reader, which opens a handle per column.
+type parquetFile struct {
+	*file.File
+}
+
+func (pf *parquetFile) Open(name string) (source.ParquetFile, error) {
+	if name == "" {
+		name = pf.Path()
+	}
+	f, err := file.New(name, os.O_RDONLY)
+	if err != nil {
+		return nil, err
+	}
+	return &parquetFile{f}, nil
+}
+
+func (pf *parquetFile) Create(name string) (source.ParquetFile, error) {
+	return nil, errors.New("parquet source is read only")
+}
+
+// parquetSource reads the rows of a parquet file, positions are row numbers.
+type parquetSource struct {
+	pf       *parquetFile
+	pr       *reader.ParquetReader
+	meta     model.Meta
+	builder  *rowBuilder
+	cols     []string
+	elements []*parquet.SchemaElement
+	rows     []interface{}
+	index    int
+	pos      int64
+	total    int64
+}
+
+func newParquetSource(s model.Source, meta model.Meta) (*parquetSource, error) {
+	ps := &parquetSource{
+		pf:      &parquetFile{s.File},
+		meta:    meta,
+		builder: newRowBuilder(meta),
+	}
+	err := ps.SeekTo(0)
+	if err != nil {
+		return nil, err
+	}
+	return ps, nil
+}
+
+// open reads the footer and collects the top level columns, the reader
+// materializes rows as structs with one field per top level column in schema order.
+func (ps *parquetSource) open() error {
+	if ps.pr != nil {
+		ps.pr.ReadStop()
+	}
+	_, err := ps.pf.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	pr, err := reader.NewParquetReader(ps.pf, nil, 1)
+	if err != nil {
+		return err
+	}
+	elements := pr.SchemaHandler.SchemaElements
+	ps.cols = ps.cols[:0]
+	ps.elements = ps.elements[:0]
+	index := 1
+	for i := int32(0); i < elements[0].GetNumChildren(); i++ {
+		ps.cols = append(ps.cols, strings.ToLower(pr.SchemaHandler.GetExName(index)))
+		ps.elements = append(ps.elements, elements[index])
+		index = skipSchema(elements, index)
+	}
+	ps.pr = pr
+	ps.total = pr.GetNumRows()
+	return nil
+}
+
+// skipSchema returns the index following the subtree of the element at index.
+func skipSchema(elements []*parquet.SchemaElement, index int) int {
+	children := elements[index].GetNumChildren()
+	index++
+	for i := int32(0); i < children; i++ {
+		index = skipSchema(elements, index)
+	}
+	return index
+}
+
+func (ps *parquetSource) NextRow() (*model.Row, error) {
+	if ps.index == len(ps.rows) {
+		if ps.pos >= ps.total {
+			return nil, io.EOF
+		}
+		n := ps.total - ps.pos
+		if n > parquetBatch {
+			n = parquetBatch
+		}
+		rows, err := ps.pr.ReadByNumber(int(n))
+		if err != nil {
+			return nil, err
+		}
+		if len(rows) == 0 {
+			return nil, io.EOF
+		}
+		ps.rows = rows
+		ps.index = 0
+	}
+	obj := reflect.ValueOf(ps.rows[ps.index])
+	ps.index++
+	ps.pos++
+	values := make(map[string]string, len(ps.cols))
+	for i, col := range ps.cols {
+		if v, ok := parquetString(obj.Field(i), ps.elements[i]); ok {
+			values[col] = v
+		}
+	}
+	fields := byName(ps.meta, values)
+	err := ps.meta.Validate(fields)
+	if err != nil {
+		return nil, &rejectError{
+			path:   ps.pf.Path(),
+			offset: ps.pos - 1,
+			reason: err.Error(),
+			line:   strings.Join(fields, ","),
+		}
+	}
+	row := ps.builder.build(fields)
+	row.Offset = ps.pos - 1
+	return row, nil
+}
+
+func parquetString(v reflect.Value, se *parquet.SchemaElement) (string, bool) {
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return "", false
+		}
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.String:
+		return v.String(), true
+	case reflect.Bool:
+		if v.Bool() {
+			return "1", true
+		}
+		return "0", true
+	case reflect.Int32, reflect.Int64:
+		i := v.Int()
+		if se.ConvertedType != nil {
+			switch *se.ConvertedType {
+			case parquet.ConvertedType_DATE:
+				return time.Unix(i*86400, 0).UTC().Format("2006-01-02"), true
+			case parquet.ConvertedType_TIMESTAMP_MILLIS:
+				return time.Unix(0, i*int64(time.Millisecond)).UTC().Format("2006-01-02 15:04:05.999"), true
+			case parquet.ConvertedType_TIMESTAMP_MICROS:
+				return time.Unix(0, i*int64(time.Microsecond)).UTC().Format("2006-01-02 15:04:05.999999"), true
+			case parquet.ConvertedType_DECIMAL:
+				return decimal.New(i, -se.GetScale()).String(), true
+			}
+		}
+		return strconv.FormatInt(i, 10), true
+	case reflect.Float32:
+		return strconv.FormatFloat(v.Float(), 'f', -1, 32), true
+	case reflect.Float64:
+		return strconv.FormatFloat(v.Float(), 'f', -1, 64), true
+	}
+	bs, err := json.Marshal(v.Interface())
+	if err != nil {
+		return fmt.Sprint(v.Interface()), true
+	}
+	return string(bs), true
+}
+
+func (ps *parquetSource) Position() int64 {
+	return ps.pos
+}
+
+func (ps *parquetSource) SeekTo(position int64) error {
+	err := ps.open()
+	if err != nil {
+		return err
+	}
+	ps.rows = nil
+	ps.index = 0
+	ps.pos = position
+	if position > 0 {
+		return ps.pr.SkipRows(position)
+	}
+	return nil
+}
+
+func (ps *parquetSource) Close() error {
+	if ps.pr != nil {
+		ps.pr.ReadStop()
+	}
+	return ps.pf.Close()
+}
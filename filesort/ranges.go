@@ -0,0 +1,283 @@
+package filesort
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"github.com/ainilili/tdsql-competition/consts"
+	"github.com/ainilili/tdsql-competition/log"
+	"github.com/ainilili/tdsql-competition/model"
+	"io"
+	"sort"
+	"strings"
+)
+
+// MergeRanges is the most key ranges the merge of a set is split into, each
+// loaded by its own connection.
+var MergeRanges = consts.MergeRanges
+
+// blockKey is the first key of the block of a shard at pos.
+type blockKey struct {
+	pos int64
+	key model.Key
+}
+
+// blockIndex returns the first key of every block, shards written before a
+// restart are scanned for it once.
+func (s *shard) blockIndex() ([]blockKey, error) {
+	if s.indexed {
+		return s.blocks, nil
+	}
+	r := openShard(s.path, s.meta)
+	defer r.Close()
+	blocks := make([]blockKey, 0)
+	for {
+		fields, err := r.readFields()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, blockKey{pos: r.blockPos, key: r.builder.build(fields).Key})
+		r.index = r.count
+	}
+	s.blocks = blocks
+	s.indexed = true
+	return blocks, nil
+}
+
+// seek moves the reader to the block holding the first row not below key.
+func (s *shard) seek(key model.Key) error {
+	blocks, err := s.blockIndex()
+	if err != nil {
+		return err
+	}
+	i := sort.Search(len(blocks), func(i int) bool {
+		return blocks[i].key.Compare(key) >= 0
+	})
+	if i > 0 {
+		s.Reset(blocks[i-1].pos << positionBits)
+	}
+	return nil
+}
+
+// setRanges splits the merge of a set at sampled keys, every range reads
+// the shards of the set through its own readers.
+type setRanges struct {
+	splitters []model.Key
+	readers   [][][]*shard
+	finished  int
+}
+
+// Ranges returns the number of key ranges the set is merged in.
+func (fs *FileSorter) Ranges(set string) (int, error) {
+	sr, err := fs.setRanges(set)
+	if err != nil {
+		return 0, err
+	}
+	return len(sr.readers), nil
+}
+
+func (fs *FileSorter) setRanges(set string) (*setRanges, error) {
+	fs.rangesLock.Lock()
+	defer fs.rangesLock.Unlock()
+	fs.Lock()
+	if fs.ranges == nil {
+		fs.ranges = map[string]*setRanges{}
+	}
+	sr, ok := fs.ranges[set]
+	fs.Unlock()
+	if ok {
+		return sr, nil
+	}
+	buckets := fs.buckets(set)
+	sr = &setRanges{}
+	if saved, ok := fs.splitters[set]; ok {
+		sr.splitters = saved
+	} else if fs.mode != model.DedupHash && MergeRanges > 1 {
+		keys := make([]model.Key, 0)
+		for _, bucket := range buckets {
+			for _, s := range fs.bucketShards(bucket) {
+				blocks, err := s.blockIndex()
+				if err != nil {
+					return nil, err
+				}
+				for _, b := range blocks {
+					keys = append(keys, b.key)
+				}
+			}
+		}
+		sr.splitters = splitters(keys, MergeRanges)
+	}
+	sr.readers = make([][][]*shard, len(sr.splitters)+1)
+	for r := range sr.readers {
+		for _, bucket := range buckets {
+			shards := fs.bucketShards(bucket)
+			readers := make([]*shard, len(shards))
+			for i, s := range shards {
+				readers[i] = s.reader()
+			}
+			sr.readers[r] = append(sr.readers[r], readers)
+		}
+	}
+	if len(sr.splitters) > 0 {
+		log.Infof("table %s_%s merge split into %d ranges\n", fs.table, set, len(sr.readers))
+	}
+	fs.Lock()
+	fs.ranges[set] = sr
+	fs.Unlock()
+	return sr, nil
+}
+
+// splitters picks up to n-1 distinct keys splitting the sorted sample evenly.
+func splitters(keys []model.Key, n int) []model.Key {
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Compare(keys[j]) < 0
+	})
+	picked := make([]model.Key, 0, n-1)
+	for i := 1; i < n; i++ {
+		k := i * len(keys) / n
+		if k == 0 || k >= len(keys) {
+			continue
+		}
+		if len(picked) > 0 && picked[len(picked)-1].Compare(keys[k]) >= 0 {
+			continue
+		}
+		picked = append(picked, keys[k])
+	}
+	return picked
+}
+
+// rangesPrefix marks the splitters of a set in the recover path of the shards.
+const rangesPrefix = ">"
+
+// formatSplitters renders the splitters of a set for the recover path, the
+// sources of the key values hex encoded as they may hold any separator.
+func formatSplitters(set string, keys []model.Key) string {
+	buf := bytes.Buffer{}
+	buf.WriteString(rangesPrefix + set)
+	for i, k := range keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		} else {
+			buf.WriteByte(':')
+		}
+		for j, v := range k {
+			if j > 0 {
+				buf.WriteByte('.')
+			}
+			buf.WriteString(hex.EncodeToString([]byte(v.Source)))
+		}
+	}
+	return buf.String()
+}
+
+func parseSplitters(meta model.Meta, info string) (string, []model.Key, error) {
+	keys := make([]model.Key, 0)
+	i := strings.IndexByte(info, ':')
+	if i == -1 {
+		return info[len(rangesPrefix):], keys, nil
+	}
+	set := info[len(rangesPrefix):i]
+	cols := meta.KeyCols()
+	for _, k := range strings.Split(info[i+1:], ",") {
+		values := strings.Split(k, ".")
+		if len(values) != len(cols) {
+			return "", nil, fmt.Errorf("invalid merge ranges %s", info)
+		}
+		key := make(model.Key, len(values))
+		for j, v := range values {
+			source, err := hex.DecodeString(v)
+			if err != nil {
+				return "", nil, fmt.Errorf("invalid merge ranges %s", info)
+			}
+			key[j] = meta.ParseValue(cols[j], string(source))
+		}
+		keys = append(keys, key)
+	}
+	return set, keys, nil
+}
+
+// bounds returns the keys range r starts and ends at, nil when open.
+func (sr *setRanges) bounds(r int) (lo, hi model.Key) {
+	if r > 0 {
+		lo = sr.splitters[r-1]
+	}
+	if r < len(sr.splitters) {
+		hi = sr.splitters[r]
+	}
+	return lo, hi
+}
+
+// rangeShards returns the readers of range r of the set, the shards the
+// positions of the range are of, the set partitions in hash mode.
+func (fs *FileSorter) rangeShards(set string, r int) []*shard {
+	if fs.mode == model.DedupHash {
+		return fs.SetShards(set)
+	}
+	sr, err := fs.setRanges(set)
+	if err != nil {
+		log.Error(err)
+		return nil
+	}
+	return sr.shards(r)
+}
+
+func (sr *setRanges) shards(r int) []*shard {
+	shards := make([]*shard, 0)
+	for _, group := range sr.readers[r] {
+		shards = append(shards, group...)
+	}
+	return shards
+}
+
+// RangeCondition returns the sql condition selecting the rows of range r of
+// the set, empty when the range holds the whole set.
+func (fs *FileSorter) RangeCondition(set string, r int) (string, error) {
+	sr, err := fs.setRanges(set)
+	if err != nil {
+		return "", err
+	}
+	lo, hi := sr.bounds(r)
+	conds := make([]string, 0, 2)
+	cols := "(`" + strings.Join(fs.table.Meta.KeyCols(), "`,`") + "`)"
+	if lo != nil {
+		conds = append(conds, cols+" >= "+fs.keyLiteral(lo))
+	}
+	if hi != nil {
+		conds = append(conds, cols+" < "+fs.keyLiteral(hi))
+	}
+	return strings.Join(conds, " AND "), nil
+}
+
+func (fs *FileSorter) keyLiteral(k model.Key) string {
+	buf := bytes.Buffer{}
+	buf.WriteByte('(')
+	for i, v := range k {
+		if i > 0 {
+			buf.WriteByte(consts.COMMA)
+		}
+		writeLiteral(&buf, v.Type, v.Source)
+	}
+	buf.WriteByte(')')
+	return buf.String()
+}
+
+// FinishRange records that range r of the set is loaded and deletes the
+// shards of the set once all its ranges are.
+func (fs *FileSorter) FinishRange(set string, r int) {
+	sr, err := fs.setRanges(set)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	fs.Lock()
+	sr.finished++
+	done := sr.finished == len(sr.readers)
+	fs.Unlock()
+	closeShards(sr.shards(r))
+	if done {
+		fs.DeleteShards(set)
+	}
+}
@@ -0,0 +1,110 @@
+package filesort
+
+import (
+	"fmt"
+	"github.com/ainilili/tdsql-competition/model"
+	"github.com/ainilili/tdsql-competition/parser"
+	"os"
+	"testing"
+)
+
+func TestFileSorter_Ranges(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer func(r int) { MergeRanges = r }(MergeRanges)
+	MergeRanges = 4
+	meta := parser.ParseTableMeta(testSchema)
+	table := &model.Table{ID: 1, Meta: meta, DB: singleSetDB("s")}
+	fs := testSorter(t, table)
+	rb := newRowBuilder(meta)
+	for run := 0; run < 3; run++ {
+		s, err := fs.newShard("7")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for id := run; id < 300; id += 3 {
+			if err = s.Write(*rb.build([]string{fmt.Sprint(id), "0", "b", "2021-12-12 00:00:00"})); err != nil {
+				t.Fatal(err)
+			}
+			if id%10 == 0 {
+				if err = s.Flush(); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		if err = s.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		_ = s.Close()
+	}
+	// a shard written before a restart has its block index scanned
+	fs.shards["7"][0].blocks, fs.shards["7"][0].indexed = nil, false
+	ranges, err := fs.Ranges("s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ranges != 4 {
+		t.Fatalf("expect 4 ranges, got %d", ranges)
+	}
+	next := 0
+	for r := 0; r < ranges; r++ {
+		lt := fs.InitLts("s", r)
+		for fs.HasNext(lt, "s") {
+			row, err := fs.Next(lt, "s")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if row.Key.String() != fmt.Sprintf("%d,0", next) {
+				t.Fatalf("range %d: expect key %d, got %s", r, next, row.Key)
+			}
+			next++
+		}
+		fs.CloseLts(lt)
+		fs.FinishRange("s", r)
+	}
+	if next != 300 {
+		t.Fatalf("expect 300 rows, got %d", next)
+	}
+	cond, err := fs.RangeCondition("s", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sr, _ := fs.setRanges("s")
+	expect := fmt.Sprintf("(`id`,`a`) >= (%s) AND (`id`,`a`) < (%s)", sr.splitters[0], sr.splitters[1])
+	if cond != expect {
+		t.Errorf("expect %s, got %s", expect, cond)
+	}
+	if _, err := os.Stat(fs.shards["7"][0].Path()); !os.IsNotExist(err) {
+		t.Errorf("expect shards deleted once all ranges finished, got %v", err)
+	}
+}
+
+func TestFileSorter_SavedRanges(t *testing.T) {
+	defer func(r int) { MergeRanges = r }(MergeRanges)
+	meta := parser.ParseTableMeta(testSchema)
+	keys := []model.Key{
+		{meta.ParseValue("id", "10"), meta.ParseValue("a", "0.5")},
+		{meta.ParseValue("id", "20"), meta.ParseValue("a", "'1;2,3:4.5'")},
+	}
+	set, parsed, err := parseSplitters(meta, formatSplitters("s", keys))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if set != "s" || len(parsed) != 2 || parsed[1].Compare(keys[1]) != 0 || parsed[1][1].Source != keys[1][1].Source {
+		t.Fatalf("unexpected splitters %s %v", set, parsed)
+	}
+	if set, parsed, err = parseSplitters(meta, formatSplitters("s", nil)); err != nil || set != "s" || len(parsed) != 0 {
+		t.Fatalf("expect a single range, got %s %v %v", set, parsed, err)
+	}
+	// a restart merges the saved ranges whatever ranges it is run with
+	MergeRanges = 8
+	fs := testSorter(t, &model.Table{ID: 1, Meta: meta, DB: singleSetDB("s")})
+	fs.splitters = map[string][]model.Key{"s": keys}
+	ranges, err := fs.Ranges("s")
+	if err != nil || ranges != 3 {
+		t.Fatalf("expect the 3 saved ranges, got %d %v", ranges, err)
+	}
+}
@@ -0,0 +1,412 @@
+package filesort
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/ainilili/tdsql-competition/consts"
+	"github.com/ainilili/tdsql-competition/file"
+	"github.com/ainilili/tdsql-competition/model"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"strconv"
+)
+
+// A shard file is a sequence of blocks, each a header followed by its payload:
+//
+//	size uint32 | raw size uint32 | crc32 uint32 | rows uint32 | flags byte
+//
+// size and crc32 cover the payload as stored, the payload is flate
+// compressed when flags has blockFlate. The raw payload is the rows of the
+// block, each a uvarint length followed by the uvarint origin and offset of
+// the row and one tagged field per column.
+const (
+	blockHeaderSize = 17
+	blockFlate      = 1
+	// positionBits is the bits of a shard position holding the row index
+	// in its block, the rest is the offset of the block.
+	positionBits = 24
+)
+
+const (
+	fieldNull byte = iota
+	fieldInt
+	fieldUint
+	fieldFloat
+	fieldString
+)
+
+// Compress makes new shards flate compress their blocks.
+var Compress = consts.ShardCompress
+
+var errCorrupted = errors.New("corrupted block")
+
+type shard struct {
+	f        *file.File
+	path     string
+	meta     model.Meta
+	builder  *rowBuilder
+	unsigned []bool
+	types    []model.Type
+
+	block bytes.Buffer
+	row   bytes.Buffer
+	rows  int
+	tmp   [binary.MaxVarintLen64]byte
+	// blocks holds the first key of each block written, first the one of
+	// the pending block.
+	blocks  []blockKey
+	first   model.Key
+	indexed bool
+
+	data     []byte
+	off      int
+	count    int
+	index    int
+	blockPos int64
+	nextPos  int64
+	size     int64
+	bytes    int64
+	skip     int
+	fields   []string
+	origin   int
+	offset   int64
+	lastPos  int64
+}
+
+func newShard(f *file.File, meta model.Meta) *shard {
+	s := openShard(f.Path(), meta)
+	s.f = f
+	return s
+}
+
+// openShard returns a shard over an existing file, opened on first read.
+func openShard(path string, meta model.Meta) *shard {
+	s := &shard{
+		path:     path,
+		meta:     meta,
+		builder:  newRowBuilder(meta),
+		unsigned: make([]bool, len(meta.Cols)),
+		types:    make([]model.Type, len(meta.Cols)),
+	}
+	for i, col := range meta.Cols {
+		s.unsigned[i] = meta.Unsigned[col]
+		s.types[i] = meta.ColsType[col]
+	}
+	return s
+}
+
+// Write appends a row, blocks are written once they reach ShardBlockSize.
+func (s *shard) Write(row model.Row) error {
+	if s.rows == 0 {
+		s.first = row.Key
+	}
+	s.row.Reset()
+	s.row.Write(s.tmp[:binary.PutUvarint(s.tmp[:], uint64(row.Origin))])
+	s.row.Write(s.tmp[:binary.PutUvarint(s.tmp[:], uint64(row.Offset))])
+	for i, field := range row.Fields {
+		s.encodeField(i, field)
+	}
+	n := binary.PutUvarint(s.tmp[:], uint64(s.row.Len()))
+	s.block.Write(s.tmp[:n])
+	s.block.Write(s.row.Bytes())
+	s.rows++
+	if s.block.Len() >= consts.ShardBlockSize {
+		return s.Flush()
+	}
+	return nil
+}
+
+func (s *shard) encodeField(i int, field string) {
+	if field == model.Null {
+		s.row.WriteByte(fieldNull)
+		return
+	}
+	var t model.Type
+	if i < len(s.types) {
+		t = s.types[i]
+	}
+	switch t {
+	case model.Bigint:
+		if s.unsigned[i] {
+			if v, err := strconv.ParseUint(field, 10, 64); err == nil {
+				s.row.WriteByte(fieldUint)
+				s.row.Write(s.tmp[:binary.PutUvarint(s.tmp[:], v)])
+				return
+			}
+		} else if v, err := strconv.ParseInt(field, 10, 64); err == nil {
+			s.row.WriteByte(fieldInt)
+			s.row.Write(s.tmp[:binary.PutVarint(s.tmp[:], v)])
+			return
+		}
+	case model.Double, model.Float:
+		if v, err := strconv.ParseFloat(field, 64); err == nil && strconv.FormatFloat(v, 'g', -1, 64) == field {
+			s.row.WriteByte(fieldFloat)
+			binary.LittleEndian.PutUint64(s.tmp[:8], math.Float64bits(v))
+			s.row.Write(s.tmp[:8])
+			return
+		}
+	}
+	s.row.WriteByte(fieldString)
+	s.row.Write(s.tmp[:binary.PutUvarint(s.tmp[:], uint64(len(field)))])
+	s.row.WriteString(field)
+}
+
+// Flush writes the pending rows as a block.
+func (s *shard) Flush() error {
+	if s.rows == 0 {
+		return nil
+	}
+	raw := s.block.Bytes()
+	payload := raw
+	flags := byte(0)
+	if Compress {
+		out := &bytes.Buffer{}
+		w, err := flate.NewWriter(out, flate.BestSpeed)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(raw)
+		if err == nil {
+			err = w.Close()
+		}
+		if err != nil {
+			return err
+		}
+		payload = out.Bytes()
+		flags |= blockFlate
+	}
+	header := make([]byte, blockHeaderSize, blockHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(header[0:], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(header[4:], uint32(len(raw)))
+	binary.LittleEndian.PutUint32(header[8:], crc32.ChecksumIEEE(payload))
+	binary.LittleEndian.PutUint32(header[12:], uint32(s.rows))
+	header[16] = flags
+	pos := s.bytes
+	n, err := s.f.Write(append(header, payload...))
+	s.bytes += int64(n)
+	if err != nil {
+		return err
+	}
+	s.blocks = append(s.blocks, blockKey{pos: pos, key: s.first})
+	s.indexed = true
+	s.block.Reset()
+	s.rows = 0
+	return nil
+}
+
+// Reset moves the reader to a position returned by LastPosition, the file
+// is read from there on the next row.
+func (s *shard) Reset(position int64) {
+	s.size = -1
+	s.data = nil
+	s.off = 0
+	s.count = 0
+	s.index = 0
+	s.nextPos = position >> positionBits
+	s.blockPos = s.nextPos
+	s.skip = int(position & (1<<positionBits - 1))
+	s.lastPos = position
+}
+
+func (s *shard) open() error {
+	if s.f == nil {
+		f, err := file.New(s.path, os.O_RDWR)
+		if err != nil {
+			return err
+		}
+		s.f = f
+		s.size = -1
+	}
+	if s.size < 0 {
+		s.size = s.f.Size()
+	}
+	return nil
+}
+
+func (s *shard) readBlock() error {
+	err := s.open()
+	if err != nil {
+		return err
+	}
+	if s.nextPos >= s.size {
+		return io.EOF
+	}
+	header := make([]byte, blockHeaderSize)
+	if s.nextPos+blockHeaderSize > s.size || s.f.ReadAt(s.nextPos, header) != nil {
+		return s.corrupted("truncated header")
+	}
+	size := int64(binary.LittleEndian.Uint32(header[0:]))
+	rawSize := int(binary.LittleEndian.Uint32(header[4:]))
+	if s.nextPos+blockHeaderSize+size > s.size {
+		return s.corrupted("truncated payload")
+	}
+	payload := make([]byte, size)
+	err = s.f.ReadAt(s.nextPos+blockHeaderSize, payload)
+	if err != nil {
+		return err
+	}
+	if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(header[8:]) {
+		return s.corrupted("checksum mismatch")
+	}
+	if header[16]&blockFlate != 0 {
+		payload, err = ioutil.ReadAll(flate.NewReader(bytes.NewReader(payload)))
+		if err != nil {
+			return s.corrupted(err.Error())
+		}
+	}
+	if len(payload) != rawSize {
+		return s.corrupted("size mismatch")
+	}
+	s.blockPos = s.nextPos
+	s.nextPos += blockHeaderSize + size
+	s.data = payload
+	s.off = 0
+	s.index = 0
+	s.count = int(binary.LittleEndian.Uint32(header[12:]))
+	for ; s.skip > 0 && s.index < s.count; s.skip-- {
+		n, k := binary.Uvarint(s.data[s.off:])
+		if k <= 0 || s.off+k+int(n) > len(s.data) {
+			return s.corrupted("bad row length")
+		}
+		s.off += k + int(n)
+		s.index++
+	}
+	return nil
+}
+
+func (s *shard) corrupted(reason string) error {
+	return fmt.Errorf("shard %s at %d: %w: %s", s.path, s.nextPos, errCorrupted, reason)
+}
+
+func (s *shard) readFields() ([]string, error) {
+	for s.index == s.count {
+		err := s.readBlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+	n, k := binary.Uvarint(s.data[s.off:])
+	if k <= 0 || s.off+k+int(n) > len(s.data) {
+		return nil, s.corrupted("bad row length")
+	}
+	s.off += k
+	row := s.data[s.off : s.off+int(n)]
+	s.off += int(n)
+	s.index++
+	origin, k := binary.Uvarint(row)
+	if k <= 0 {
+		return nil, s.corrupted("bad origin")
+	}
+	row = row[k:]
+	offset, k := binary.Uvarint(row)
+	if k <= 0 {
+		return nil, s.corrupted("bad offset")
+	}
+	row = row[k:]
+	s.origin, s.offset = int(origin), int64(offset)
+	s.fields = s.fields[:0]
+	for len(row) > 0 {
+		tag := row[0]
+		row = row[1:]
+		switch tag {
+		case fieldNull:
+			s.fields = append(s.fields, model.Null)
+			continue
+		case fieldInt:
+			v, k := binary.Varint(row)
+			if k > 0 {
+				s.fields = append(s.fields, strconv.FormatInt(v, 10))
+				row = row[k:]
+				continue
+			}
+		case fieldUint:
+			v, k := binary.Uvarint(row)
+			if k > 0 {
+				s.fields = append(s.fields, strconv.FormatUint(v, 10))
+				row = row[k:]
+				continue
+			}
+		case fieldFloat:
+			if len(row) >= 8 {
+				v := math.Float64frombits(binary.LittleEndian.Uint64(row))
+				s.fields = append(s.fields, strconv.FormatFloat(v, 'g', -1, 64))
+				row = row[8:]
+				continue
+			}
+		case fieldString:
+			l, k := binary.Uvarint(row)
+			if k > 0 && k+int(l) <= len(row) {
+				s.fields = append(s.fields, string(row[k:k+int(l)]))
+				row = row[k+int(l):]
+				continue
+			}
+		}
+		return nil, s.corrupted("bad field")
+	}
+	return s.fields, nil
+}
+
+func (s *shard) NextRow() (*model.Row, error) {
+	s.lastPos = s.Position()
+	fields, err := s.readFields()
+	if err != nil {
+		return nil, err
+	}
+	row := s.builder.build(fields)
+	row.Origin, row.Offset = s.origin, s.offset
+	return row, nil
+}
+
+// Position returns the position following the last row read.
+func (s *shard) Position() int64 {
+	if s.data == nil {
+		return s.nextPos<<positionBits | int64(s.skip)
+	}
+	if s.index == s.count {
+		return s.nextPos << positionBits
+	}
+	return s.blockPos<<positionBits | int64(s.index)
+}
+
+func (s *shard) SeekTo(position int64) error {
+	s.Reset(position)
+	return nil
+}
+
+func (s *shard) LastPosition() int64 {
+	return s.lastPos
+}
+
+func (s *shard) Path() string {
+	return s.path
+}
+
+// reader returns a shard reading the same file with its own cursor.
+func (s *shard) reader() *shard {
+	r := openShard(s.path, s.meta)
+	r.bytes = s.bytes
+	r.blocks = s.blocks
+	r.indexed = s.indexed
+	return r
+}
+
+func (s *shard) Delete() {
+	_ = s.Close()
+	_ = os.Remove(s.path)
+}
+
+// Close releases the file handle, the shard reopens it to read again.
+func (s *shard) Close() error {
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f = nil
+	return err
+}
@@ -0,0 +1,77 @@
+package filesort
+
+import (
+	"errors"
+	"github.com/ainilili/tdsql-competition/file"
+	"github.com/ainilili/tdsql-competition/model"
+	"github.com/ainilili/tdsql-competition/parser"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeShard(t *testing.T, meta model.Meta, lines [][]string) *shard {
+	f, err := file.New(filepath.Join(t.TempDir(), "shard"), os.O_CREATE|os.O_RDWR|os.O_TRUNC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newShard(f, meta)
+	rb := newRowBuilder(meta)
+	for _, fields := range lines {
+		if err := s.Write(*rb.build(fields)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	s.Reset(0)
+	return s
+}
+
+func TestShard(t *testing.T) {
+	meta := parser.ParseTableMeta(testSchema)
+	rb := newRowBuilder(meta)
+	lines := [][]string{
+		{"1", "0.5", "a,b", "2021-12-12 00:00:00"},
+		{"18446744073709551615", "1.50", "it's", "2021-12-12 00:00:01"},
+		{"3", "-2", model.Null, "2021-12-12 00:00:02"},
+	}
+	for _, compress := range []bool{false, true} {
+		Compress = compress
+		s := writeShard(t, meta, lines)
+		rows := readAll(t, s)
+		expects := make([]string, len(lines))
+		for i, fields := range lines {
+			expects[i] = rb.build(fields).String()
+		}
+		expectRows(t, expects, rows)
+
+		s.Reset(0)
+		_, _ = s.NextRow()
+		_, _ = s.NextRow()
+		pos := s.LastPosition()
+		s.Reset(pos)
+		expectRows(t, expects[1:], readAll(t, s))
+	}
+	Compress = false
+}
+
+func TestShard_Corrupted(t *testing.T) {
+	meta := parser.ParseTableMeta(testSchema)
+	s := writeShard(t, meta, [][]string{{"1", "0.5", "abc", "2021-12-12 00:00:00"}})
+	err := s.f.WriteAt(blockHeaderSize+3, []byte{0xff})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Reset(0)
+	_, err = s.NextRow()
+	if !errors.Is(err, errCorrupted) {
+		t.Fatalf("expect corrupted block, got %v", err)
+	}
+	s.Reset(s.f.Size() << positionBits)
+	if _, err = s.NextRow(); err != io.EOF {
+		t.Fatalf("expect EOF, got %v", err)
+	}
+}
@@ -0,0 +1,244 @@
+package filesort
+
+import (
+	"encoding/binary"
+	"github.com/ainilili/tdsql-competition/model"
+	"github.com/shopspring/decimal"
+	"math"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+)
+
+// parallelSortSize is the run length from which a run is sorted in chunks
+// on all cores and the chunks merged.
+const parallelSortSize = 1 << 16
+
+// sortEntry stands for a row of a run while sorting, prefix is an order
+// preserving fixed width image of the first key column.
+type sortEntry struct {
+	prefix uint64
+	index  int32
+}
+
+const (
+	kindNone = iota
+	kindInt
+	kindUint
+	kindFloat
+	kindTime
+	kindString
+)
+
+// keyPrefix maps a key value to a uint64 ordered like the values of its
+// kind, equal prefixes still need the full key compared.
+func keyPrefix(v model.Value) (uint64, int) {
+	switch a := v.Value.(type) {
+	case nil:
+		return 0, kindNone
+	case int64:
+		return uint64(a) ^ 1<<63, kindInt
+	case uint64:
+		return a, kindUint
+	case float64:
+		return floatPrefix(a), kindFloat
+	case decimal.Decimal:
+		f, _ := a.Float64()
+		return floatPrefix(f), kindFloat
+	case time.Time:
+		return uint64(a.Unix()) ^ 1<<63, kindTime
+	case string:
+		var b [8]byte
+		copy(b[:], a)
+		return binary.BigEndian.Uint64(b[:]), kindString
+	}
+	return 0, -1
+}
+
+func floatPrefix(f float64) uint64 {
+	bits := math.Float64bits(f)
+	if bits&(1<<63) != 0 {
+		return ^bits
+	}
+	return bits | 1<<63
+}
+
+// sortRuns sorts the runs of all buckets concurrently.
+func sortRuns(rows map[string]model.Rows) map[string][]int32 {
+	orders := make(map[string][]int32, len(rows))
+	lock := sync.Mutex{}
+	workers := make(chan bool, runtime.GOMAXPROCS(0))
+	wg := sync.WaitGroup{}
+	wg.Add(len(rows))
+	for bucket, rs := range rows {
+		bucket, rs := bucket, rs
+		workers <- true
+		go func() {
+			defer func() {
+				<-workers
+				wg.Add(-1)
+			}()
+			order := sortRun(rs)
+			lock.Lock()
+			orders[bucket] = order
+			lock.Unlock()
+		}()
+	}
+	wg.Wait()
+	return orders
+}
+
+// sortRun returns the indexes of the rows of a run in key order, rows are not moved.
+func sortRun(rs model.Rows) []int32 {
+	entries := make([]sortEntry, len(rs))
+	kind := kindNone
+	typed := true
+	for i := range rs {
+		var prefix uint64
+		if len(rs[i].Key) > 0 {
+			var k int
+			prefix, k = keyPrefix(rs[i].Key[0])
+			if k == -1 || (k != kindNone && kind != kindNone && k != kind) {
+				typed = false
+			} else if k != kindNone {
+				kind = k
+			}
+		}
+		entries[i] = sortEntry{prefix: prefix, index: int32(i)}
+	}
+	compare := func(a, b sortEntry) int {
+		if a.prefix != b.prefix {
+			if a.prefix < b.prefix {
+				return -1
+			}
+			return 1
+		}
+		return rs[a.index].Key.Compare(rs[b.index].Key)
+	}
+	if !typed {
+		// values of mixed kinds compare by their text, which prefixes do not preserve
+		sort.Slice(entries, func(i, j int) bool {
+			return rs[entries[i].index].Key.Compare(rs[entries[j].index].Key) < 0
+		})
+	} else {
+		parallelSort(entries, compare)
+	}
+	order := make([]int32, len(entries))
+	for i, e := range entries {
+		order[i] = e.index
+	}
+	return order
+}
+
+// parallelSort sorts chunks of the entries concurrently and merges them pairwise.
+func parallelSort(entries []sortEntry, compare func(a, b sortEntry) int) {
+	p := runtime.GOMAXPROCS(0)
+	if len(entries) < parallelSortSize || p < 2 {
+		radixSort(entries, make([]sortEntry, len(entries)), compare)
+		return
+	}
+	size := (len(entries) + p - 1) / p
+	bounds := make([]int, 0, p+1)
+	for i := 0; i < len(entries); i += size {
+		bounds = append(bounds, i)
+	}
+	bounds = append(bounds, len(entries))
+	tmp := make([]sortEntry, len(entries))
+	wg := sync.WaitGroup{}
+	wg.Add(len(bounds) - 1)
+	for i := 0; i < len(bounds)-1; i++ {
+		lo, hi := bounds[i], bounds[i+1]
+		go func() {
+			defer wg.Add(-1)
+			radixSort(entries[lo:hi], tmp[lo:hi], compare)
+		}()
+	}
+	wg.Wait()
+	src, dst := entries, tmp
+	for len(bounds) > 2 {
+		next := make([]int, 0, len(bounds)/2+1)
+		wg.Add((len(bounds) - 1) / 2)
+		for i := 0; i+2 < len(bounds); i += 2 {
+			lo, mid, hi := bounds[i], bounds[i+1], bounds[i+2]
+			next = append(next, lo)
+			go func() {
+				defer wg.Add(-1)
+				mergeEntries(dst[lo:hi], src[lo:mid], src[mid:hi], compare)
+			}()
+		}
+		if (len(bounds)-1)%2 == 1 {
+			lo, hi := bounds[len(bounds)-2], bounds[len(bounds)-1]
+			next = append(next, lo)
+			copy(dst[lo:hi], src[lo:hi])
+		}
+		wg.Wait()
+		bounds = append(next, len(entries))
+		src, dst = dst, src
+	}
+	if &src[0] != &entries[0] {
+		copy(entries, src)
+	}
+}
+
+func mergeEntries(dst, a, b []sortEntry, compare func(a, b sortEntry) int) {
+	i, j, k := 0, 0, 0
+	for i < len(a) && j < len(b) {
+		if compare(b[j], a[i]) < 0 {
+			dst[k] = b[j]
+			j++
+		} else {
+			dst[k] = a[i]
+			i++
+		}
+		k++
+	}
+	k += copy(dst[k:], a[i:])
+	copy(dst[k:], b[j:])
+}
+
+// radixSort sorts by prefix a byte at a time from the least significant
+// byte, skipping bytes all entries share, then orders equal prefixes by compare.
+func radixSort(entries, tmp []sortEntry, compare func(a, b sortEntry) int) {
+	if len(entries) < 2 {
+		return
+	}
+	src, dst := entries, tmp
+	var counts [256]int
+	for shift := uint(0); shift < 64; shift += 8 {
+		counts = [256]int{}
+		for _, e := range src {
+			counts[byte(e.prefix>>shift)]++
+		}
+		if counts[byte(src[0].prefix>>shift)] == len(src) {
+			continue
+		}
+		offset := 0
+		for b, c := range counts {
+			counts[b] = offset
+			offset += c
+		}
+		for _, e := range src {
+			b := byte(e.prefix >> shift)
+			dst[counts[b]] = e
+			counts[b]++
+		}
+		src, dst = dst, src
+	}
+	if &src[0] != &entries[0] {
+		copy(entries, src)
+	}
+	for i := 0; i < len(entries); {
+		j := i + 1
+		for j < len(entries) && entries[j].prefix == entries[i].prefix {
+			j++
+		}
+		if j-i > 1 {
+			ties := entries[i:j]
+			sort.Slice(ties, func(a, b int) bool {
+				return compare(ties[a], ties[b]) < 0
+			})
+		}
+		i = j
+	}
+}
@@ -0,0 +1,118 @@
+package filesort
+
+import (
+	"bytes"
+	"github.com/ainilili/tdsql-competition/consts"
+	"github.com/ainilili/tdsql-competition/model"
+	"strings"
+)
+
+// Source is a stream of rows read from one data file, Position returns the
+// offset after the last row read and Seek resumes reading from such an offset.
+type Source interface {
+	NextRow() (*model.Row, error)
+	Position() int64
+	SeekTo(position int64) error
+	Close() error
+}
+
+func newSource(s model.Source, meta model.Meta) (Source, error) {
+	format := s.Format
+	if format == "" {
+		format = model.FormatOf(s.File.Path())
+	}
+	switch format {
+	case model.FormatJSONLines:
+		return newJSONLinesSource(s, meta)
+	case model.FormatParquet:
+		return newParquetSource(s, meta)
+	case model.FormatMysqldump:
+		return newDumpSource(s, meta)
+	}
+	return newSourceBuffer(s, meta)
+}
+
+var escaper = strings.NewReplacer("\\", "\\\\", "'", "\\'", "\n", "\\n", "\r", "\\r", "\x00", "\\0")
+
+// rowBuilder renders fields in schema order into the sql tuple and typed key of a row.
+type rowBuilder struct {
+	meta model.Meta
+	keys []string
+	tags []int
+	tms  bytes.Buffer
+}
+
+func newRowBuilder(meta model.Meta) *rowBuilder {
+	keys := meta.KeyCols()
+	tags := make([]int, len(keys))
+	for i, col := range keys {
+		tags[i] = meta.ColsIndex[col]
+	}
+	return &rowBuilder{
+		meta: meta,
+		keys: keys,
+		tags: tags,
+	}
+}
+
+func (rb *rowBuilder) build(fields []string) *model.Row {
+	row := model.Row{}
+	rb.tms.Reset()
+	for index, s := range fields {
+		var t model.Type
+		if index < len(rb.meta.Cols) {
+			t = rb.meta.ColsType[rb.meta.Cols[index]]
+		}
+		writeLiteral(&rb.tms, t, s)
+		if index < len(fields)-1 {
+			rb.tms.WriteByte(consts.COMMA)
+		}
+	}
+	row.Source = rb.tms.String()
+	row.Fields = append(make([]string, 0, len(fields)), fields...)
+	row.Key = make(model.Key, 0, len(rb.tags))
+	for i, index := range rb.tags {
+		if index < len(fields) {
+			row.Key = append(row.Key, rb.meta.ParseValue(rb.keys[i], fields[index]))
+		}
+	}
+	return &row
+}
+
+// writeLiteral renders a field of type t as a sql literal.
+func writeLiteral(buf *bytes.Buffer, t model.Type, s string) {
+	if s == model.Null {
+		buf.WriteString("NULL")
+	} else if t.IsString() && (len(s) == 0 || s[0] != '\'') {
+		buf.WriteByte('\'')
+		buf.WriteString(escaper.Replace(s))
+		buf.WriteByte('\'')
+	} else {
+		buf.WriteString(s)
+	}
+}
+
+// byName orders named values decoded from JSON lines, Parquet and mysqldump
+// files by the schema, columns left out take their default value.
+func byName(meta model.Meta, values map[string]string) []string {
+	fields := make([]string, len(meta.Cols))
+	for i, col := range meta.Cols {
+		v, ok := values[col]
+		if !ok {
+			v = meta.DefaultValue[col]
+		} else {
+			v = decoded(meta.ColsType[col], v)
+		}
+		fields[i] = v
+	}
+	return fields
+}
+
+// decoded renders a decoded value as a field, strings are quoted and escaped
+// so that they never pass through as sql like the tokens of csv files.
+func decoded(t model.Type, v string) string {
+	if t.IsString() {
+		return "'" + escaper.Replace(v) + "'"
+	}
+	return v
+}
@@ -0,0 +1,291 @@
+package filesort
+
+import (
+	"github.com/ainilili/tdsql-competition/file"
+	"github.com/ainilili/tdsql-competition/model"
+	"github.com/ainilili/tdsql-competition/parser"
+	"github.com/xitongsys/parquet-go/source"
+	"github.com/xitongsys/parquet-go/writer"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testSchema = "CREATE TABLE if not exists `2` (\n  `id` bigint(20) unsigned NOT NULL,\n  `a` float NOT NULL DEFAULT '0',\n  `b` char(32) NOT NULL DEFAULT '',\n  `updated_at` datetime NOT NULL DEFAULT '2021-12-12 00:00:00',\n  PRIMARY KEY (`id`,`a`)\n) ENGINE=InnoDB DEFAULT CHARSET=utf8"
+
+func readAll(t *testing.T, s Source) []string {
+	rows := make([]string, 0)
+	for {
+		row, err := s.NextRow()
+		if err == io.EOF {
+			return rows
+		}
+		if _, ok := err.(*rejectError); ok {
+			rows = append(rows, "reject")
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows = append(rows, row.String())
+	}
+}
+
+func expectRows(t *testing.T, expects, rows []string) {
+	if len(rows) != len(expects) {
+		t.Fatalf("expect %v, got %v", expects, rows)
+	}
+	for i := range rows {
+		if rows[i] != expects[i] {
+			t.Fatalf("expect %v, got %v", expects, rows)
+		}
+	}
+}
+
+func TestJSONLinesSource(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "1.jsonl")
+	data := `{"id": 1, "a": 0.5, "b": "x", "updated_at": "2021-12-12 00:00:00"}
+{"ID": 2, "b": null, "updated_at": "2021-12-13 00:00:00", "extra": [1]}
+{"id": "y", "a": 0.5}
+{"id": 3,
+{"id": 4, "a": 1e3, "b": "z", "updated_at": "2021-12-14 00:00:00"}
+`
+	err := ioutil.WriteFile(path, []byte(data), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := file.New(path, os.O_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := newSource(model.Source{File: f}, parser.ParseTableMeta(testSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectRows(t, []string{
+		"1,0.5,'x','2021-12-12 00:00:00'",
+		"2,0,'','2021-12-13 00:00:00'",
+		"reject",
+		"reject",
+		"4,1e3,'z','2021-12-14 00:00:00'",
+	}, readAll(t, s))
+	err = s.SeekTo(int64(len(data) - 68))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectRows(t, []string{"4,1e3,'z','2021-12-14 00:00:00'"}, readAll(t, s))
+	_ = s.Close()
+}
+
+func TestJSONLinesSource_Quote(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "1.jsonl")
+	data := `{"id": 1, "b": "'); DROP TABLE t; --"}
+{"id": 2, "b": "'abc"}
+{"id": 3, "b": "'abc'"}
+{"id": 4, "b": "\\N"}
+`
+	err := ioutil.WriteFile(path, []byte(data), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := file.New(path, os.O_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := newSource(model.Source{File: f}, parser.ParseTableMeta(testSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectRows(t, []string{
+		`1,0,'\'); DROP TABLE t; --','2021-12-12 00:00:00'`,
+		`2,0,'\'abc','2021-12-12 00:00:00'`,
+		`3,0,'\'abc\'','2021-12-12 00:00:00'`,
+		`4,0,'\\N','2021-12-12 00:00:00'`,
+	}, readAll(t, s))
+	_ = s.Close()
+}
+
+type testParquetFile struct {
+	*os.File
+}
+
+func (f *testParquetFile) Open(name string) (source.ParquetFile, error) {
+	of, err := os.Open(name)
+	return &testParquetFile{of}, err
+}
+
+func (f *testParquetFile) Create(name string) (source.ParquetFile, error) {
+	of, err := os.Create(name)
+	return &testParquetFile{of}, err
+}
+
+type testParquetRow struct {
+	ID        int64   `parquet:"name=id, type=INT64"`
+	A         float32 `parquet:"name=a, type=FLOAT"`
+	B         *string `parquet:"name=b, type=UTF8, repetitiontype=OPTIONAL"`
+	UpdatedAt int64   `parquet:"name=Updated_At, type=TIMESTAMP_MILLIS"`
+}
+
+func TestParquetSource(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "1.parquet")
+	pf, err := (&testParquetFile{}).Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pw, err := writer.NewParquetWriter(pf, new(testParquetRow), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updatedAt := time.Date(2021, 12, 12, 0, 0, 0, 0, time.UTC).UnixNano() / 1e6
+	b := "x"
+	for i := 1; i <= 3; i++ {
+		row := testParquetRow{ID: int64(i), A: 0.5, UpdatedAt: updatedAt}
+		if i != 2 {
+			row.B = &b
+		}
+		err = pw.Write(row)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = pw.WriteStop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = pf.Close()
+
+	f, err := file.New(path, os.O_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := newSource(model.Source{File: f}, parser.ParseTableMeta(testSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectRows(t, []string{
+		"1,0.5,'x','2021-12-12 00:00:00'",
+		"2,0.5,'','2021-12-12 00:00:00'",
+		"3,0.5,'x','2021-12-12 00:00:00'",
+	}, readAll(t, s))
+	err = s.SeekTo(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectRows(t, []string{"3,0.5,'x','2021-12-12 00:00:00'"}, readAll(t, s))
+	_ = s.Close()
+}
+
+func TestDumpSource(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a.dump")
+	data := "CREATE TABLE `1` (\n  `id` bigint(20) unsigned NOT NULL,\n  `b` char(32) DEFAULT NULL,\n  PRIMARY KEY (`id`)\n) ENGINE=InnoDB;\n" +
+		"INSERT INTO `1` VALUES (1,'it\\'s'),(2,NULL),('x','y');\nINSERT INTO `2` VALUES (5,'z');\nINSERT INTO `1` VALUES (3,'a\\\\b');\nINSERT INTO `1` (`b`,`id`) VALUES ('c',4),('d',5);\n"
+	err := ioutil.WriteFile(path, []byte(data), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, schemas, err := parser.ParseDumpFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := file.New(path, os.O_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := newSource(model.Source{File: f, Table: "1"}, parser.ParseTableMeta(schemas["1"]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	row, err := s.NextRow()
+	if err != nil || row.String() != "1,'it\\'s'" {
+		t.Fatalf("unexpected row %v %v", row, err)
+	}
+	pos := s.Position()
+	expectRows(t, []string{"2,NULL", "reject", "3,'a\\\\b'", "4,'c'", "5,'d'"}, readAll(t, s))
+	err = s.SeekTo(pos)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectRows(t, []string{"2,NULL", "reject", "3,'a\\\\b'", "4,'c'", "5,'d'"}, readAll(t, s))
+	// a new source resumes inside an INSERT with its column list
+	_ = s.Close()
+	f, err = file.New(path, os.O_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err = newSource(model.Source{File: f, Table: "1"}, parser.ParseTableMeta(schemas["1"]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.SeekTo(int64(len(data) - 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectRows(t, []string{"5,'d'"}, readAll(t, s))
+	if s.SeekTo(int64(len(data)-11)) == nil {
+		t.Fatal("expect a position inside a row to fail")
+	}
+	_ = s.Close()
+}
+
+func TestDumpSource_Quote(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a.dump")
+	data := "CREATE TABLE `1` (\n  `id` bigint(20) unsigned NOT NULL,\n  `b` char(32) DEFAULT NULL,\n  PRIMARY KEY (`id`)\n) ENGINE=InnoDB;\n" +
+		"INSERT INTO `1` VALUES (1,'\\'); DROP TABLE x; -- '),(2,'a\\\\b'),(3,'\\\\N'),(4,NULL);\n" +
+		"INSERT INTO `1` (`b`,`id`) VALUES ('\\'',5),(NULL,6);\n"
+	err := ioutil.WriteFile(path, []byte(data), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, schemas, err := parser.ParseDumpFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := file.New(path, os.O_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := newSource(model.Source{File: f, Table: "1"}, parser.ParseTableMeta(schemas["1"]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectRows(t, []string{
+		`1,'\'); DROP TABLE x; -- '`,
+		`2,'a\\b'`,
+		`3,'\\N'`,
+		`4,NULL`,
+		`5,'\''`,
+		`6,NULL`,
+	}, readAll(t, s))
+	_ = s.Close()
+}
+
+func TestRowBuilder_Key(t *testing.T) {
+	meta := parser.ParseTableMeta("CREATE TABLE if not exists `t` (\n  `id` bigint(20) unsigned NOT NULL,\n  `d` decimal(10,2) NOT NULL,\n  `b` char(32) NOT NULL,\n  `updated_at` datetime NOT NULL,\n  PRIMARY KEY (`id`,`d`,`b`)\n) ENGINE=InnoDB DEFAULT CHARSET=utf8")
+	rb := newRowBuilder(meta)
+	key := func(fields ...string) model.Key {
+		return rb.build(append(fields, "2021-12-12 00:00:00")).Key
+	}
+	ordered := []model.Key{
+		key("9", "1.5", "a"),
+		key("10", "1.5", "a"),
+		key("10", "10.00", "a"),
+		key("10", "10.00", "b"),
+		key("18446744073709551615", "0", "a"),
+	}
+	for i := 1; i < len(ordered); i++ {
+		if ordered[i-1].Compare(ordered[i]) >= 0 {
+			t.Fatalf("expect %v < %v", ordered[i-1], ordered[i])
+		}
+	}
+	if c := key("1", "1.50", "Abc ").Compare(key("1", "1.5", "'abc'")); c != 0 {
+		t.Fatalf("expect equal keys, got %d", c)
+	}
+	// float columns compare in single precision
+	floats := parser.ParseTableMeta(testSchema)
+	if c := floats.ParseValue("a", "0.1").Compare(floats.ParseValue("a", "0.100000001")); c != 0 {
+		t.Fatalf("expect equal floats, got %d", c)
+	}
+}
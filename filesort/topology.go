@@ -0,0 +1,113 @@
+package filesort
+
+import (
+	"github.com/ainilili/tdsql-competition/log"
+	"github.com/ainilili/tdsql-competition/model"
+	"strconv"
+)
+
+// pin fixes the set of every bucket, the recovered owners or the sets the
+// partitioner maps them to now. A set loads its pinned buckets whatever the
+// topology becomes, so its ranges and checkpoints stay valid, and sends the
+// rows of buckets that moved to their new set.
+func (fs *FileSorter) pin(owners map[string]string) {
+	n := fs.partitioner.Buckets()
+	pinned := make([]string, n)
+	for i := range pinned {
+		if set, ok := owners[strconv.Itoa(i)]; ok {
+			pinned[i] = set
+		} else if owners == nil {
+			pinned[i] = fs.partitioner.Set(i)
+		}
+	}
+	fs.Lock()
+	fs.owners = pinned
+	fs.routes = nil
+	fs.Unlock()
+	fs.Rebalance()
+}
+
+// owner returns the set a bucket is pinned to.
+func (fs *FileSorter) owner(bucket string) string {
+	i, _ := strconv.Atoi(bucket)
+	fs.Lock()
+	defer fs.Unlock()
+	if i < len(fs.owners) && fs.owners[i] != "" {
+		return fs.owners[i]
+	}
+	return fs.partitioner.Set(i)
+}
+
+// Rebalance reads the sets the partitioner maps the buckets to now and
+// returns the sets whose rows go elsewhere than before, their loaders
+// restart from their checkpoints to route the rest.
+func (fs *FileSorter) Rebalance() []string {
+	routes := make([]string, fs.partitioner.Buckets())
+	for i := range routes {
+		routes[i] = fs.partitioner.Set(i)
+	}
+	fs.Lock()
+	defer fs.Unlock()
+	if fs.owners == nil {
+		return nil
+	}
+	moved := map[string]bool{}
+	changed := map[string]bool{}
+	for i, set := range routes {
+		owner := fs.owners[i]
+		if owner == "" || len(fs.shards[strconv.Itoa(i)]) == 0 {
+			continue
+		}
+		if set != owner {
+			moved[owner] = true
+		}
+		if fs.routes != nil && fs.routes[i] != set {
+			changed[owner] = true
+		}
+	}
+	if fs.epochs == nil {
+		fs.epochs = map[string]int{}
+	}
+	sets := make([]string, 0, len(changed))
+	for set := range changed {
+		fs.epochs[set]++
+		sets = append(sets, set)
+	}
+	fs.routes, fs.moved = routes, moved
+	return sets
+}
+
+// Epoch counts the route changes of the buckets of a set.
+func (fs *FileSorter) Epoch(set string) int {
+	fs.Lock()
+	defer fs.Unlock()
+	return fs.epochs[set]
+}
+
+// Rerouted tells whether rows of a set now go to other sets, they cannot be
+// counted on the set to find where its load stopped.
+func (fs *FileSorter) Rerouted(set string) bool {
+	fs.Lock()
+	defer fs.Unlock()
+	return fs.moved[set]
+}
+
+// Route returns the set a row of a set is loaded into, the set that owns
+// its bucket now.
+func (fs *FileSorter) Route(set string, row *model.Row) string {
+	fs.Lock()
+	moved := fs.moved[set]
+	fs.Unlock()
+	if !moved {
+		return set
+	}
+	bucket, err := fs.bucketOf(row)
+	if err != nil {
+		log.Errorf("table %s: %v\n", fs.table, err)
+		return set
+	}
+	i, _ := strconv.Atoi(bucket)
+	fs.Lock()
+	defer fs.Unlock()
+	return fs.routes[i]
+}
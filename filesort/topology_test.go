@@ -0,0 +1,86 @@
+package filesort
+
+import (
+	"fmt"
+	"github.com/ainilili/tdsql-competition/database"
+	"github.com/ainilili/tdsql-competition/model"
+	"github.com/ainilili/tdsql-competition/parser"
+	"os"
+	"strconv"
+	"testing"
+)
+
+func TestFileSorter_Rebalance(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	meta := parser.ParseTableMeta(testSchema)
+	db := singleSetDB("a")
+	fs := testSorter(t, &model.Table{ID: 1, Meta: meta, DB: db})
+	rb := newRowBuilder(meta)
+	rows := make([]*model.Row, 0)
+	rs := map[string]model.Rows{}
+	for id := 0; id < 200; id++ {
+		row := rb.build([]string{fmt.Sprint(id), "0", "b", "2021-12-12 00:00:00"})
+		bucket, err := fs.bucketOf(row)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rs[bucket] = append(rs[bucket], *row)
+		rows = append(rows, row)
+	}
+	if err := fs.writeRun(rs); err != nil {
+		t.Fatal(err)
+	}
+	fs.pin(nil)
+	pinned := len(fs.buckets("a"))
+	// the proxy moves the odd buckets to a new set while loading
+	hash := make([]string, database.Buckets)
+	for i := range hash {
+		hash[i] = "a"
+		if i%2 == 1 {
+			hash[i] = "b"
+		}
+	}
+	db.SetTopology([]string{"a", "b"}, hash)
+	if sets := fs.Rebalance(); len(sets) != 1 || sets[0] != "a" {
+		t.Fatalf("expect set a to reroute, got %v", sets)
+	}
+	if fs.Epoch("a") != 1 || !fs.Rerouted("a") || fs.Rerouted("b") {
+		t.Fatalf("expect only set a rerouted")
+	}
+	if n := len(fs.buckets("a")); n != pinned || len(fs.buckets("b")) != 0 {
+		t.Fatalf("expect the buckets to stay pinned to a, got %d of %d", n, pinned)
+	}
+	for _, row := range rows {
+		bucket, _ := fs.bucketOf(row)
+		i, _ := strconv.Atoi(bucket)
+		if to := fs.Route("a", row); to != hash[i] {
+			t.Fatalf("expect bucket %d routed to %s, got %s", i, hash[i], to)
+		}
+	}
+	if len(fs.Sets()) != 2 {
+		t.Fatalf("expect sets a and b, got %v", fs.Sets())
+	}
+	// a restart keeps the pinned owners of the recover path
+	path := ""
+	for bucket, shards := range fs.shards {
+		if path != "" {
+			path += ";"
+		}
+		path += bucket + "@" + fs.owner(bucket) + ":" + shards[0].Path()
+	}
+	path += ";" + formatSplitters("a", nil)
+	recovered, err := recoverFileSort(fs.table, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(recovered.buckets("a")); n != pinned || !recovered.Rerouted("a") {
+		t.Fatalf("expect %d recovered buckets of a rerouted, got %d", pinned, n)
+	}
+	if splitters, ok := recovered.splitters["a"]; !ok || len(splitters) != 0 {
+		t.Fatalf("expect the saved single range of a, got %v", splitters)
+	}
+}
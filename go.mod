@@ -7,4 +7,7 @@ require (
 	github.com/go-mysql-org/go-mysql v1.4.0
 	github.com/go-sql-driver/mysql v1.5.0
 	github.com/shopspring/decimal v0.0.0-20180709203117-cd690d0c9e24
+	github.com/xitongsys/parquet-go v1.5.4
+	golang.org/x/text v0.3.6
+	gopkg.in/yaml.v2 v2.2.2
 )
@@ -0,0 +1,160 @@
+// Package merge merges sorted streams with a loser tree.
+package merge
+
+import "io"
+
+// Iterator is a stream of items in ascending order, Next returns io.EOF after the last.
+type Iterator interface {
+	Next() (interface{}, error)
+}
+
+// IteratorFunc adapts a function to an Iterator.
+type IteratorFunc func() (interface{}, error)
+
+func (f IteratorFunc) Next() (interface{}, error) {
+	return f()
+}
+
+// Slice iterates over sorted items.
+func Slice(items []interface{}) Iterator {
+	i := 0
+	return IteratorFunc(func() (interface{}, error) {
+		if i == len(items) {
+			return nil, io.EOF
+		}
+		i++
+		return items[i-1], nil
+	})
+}
+
+// Compare orders two items, negative when a comes first and zero when equal.
+type Compare func(a, b interface{}) int
+
+// Combine folds an item equal to the kept one into it and returns the item to keep.
+type Combine func(kept, dup interface{}) interface{}
+
+// Merger yields the items of its iterators in order. Equal items come in
+// the order of their iterators, or folded into one when Combine is set.
+type Merger struct {
+	its     []Iterator
+	heads   []interface{}
+	done    []bool
+	tree    []int
+	compare Compare
+	combine Combine
+	err     error
+}
+
+// New reads the first item of every iterator and builds the tree.
+func New(its []Iterator, compare Compare, combine Combine) (*Merger, error) {
+	m := &Merger{
+		its:     its,
+		heads:   make([]interface{}, len(its)),
+		done:    make([]bool, len(its)),
+		tree:    make([]int, len(its)),
+		compare: compare,
+		combine: combine,
+	}
+	for i := range its {
+		err := m.advance(i)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(its) > 0 {
+		m.tree[0] = m.play(1)
+	}
+	return m, nil
+}
+
+// play returns the winner of the subtree at node and records the losers,
+// leaves are the nodes from len(its).
+func (m *Merger) play(node int) int {
+	k := len(m.its)
+	if node >= k {
+		return node - k
+	}
+	a, b := m.play(2*node), m.play(2*node+1)
+	if m.less(b, a) {
+		m.tree[node] = a
+		return b
+	}
+	m.tree[node] = b
+	return a
+}
+
+// adjust replays the matches on the path of leaf i after its head changed.
+func (m *Merger) adjust(i int) {
+	winner := i
+	for node := (i + len(m.its)) / 2; node > 0; node /= 2 {
+		if m.less(m.tree[node], winner) {
+			m.tree[node], winner = winner, m.tree[node]
+		}
+	}
+	m.tree[0] = winner
+}
+
+// less orders the heads of two iterators, exhausted ones last.
+func (m *Merger) less(i, j int) bool {
+	if m.done[i] || m.done[j] {
+		return !m.done[i]
+	}
+	if c := m.compare(m.heads[i], m.heads[j]); c != 0 {
+		return c < 0
+	}
+	return i < j
+}
+
+func (m *Merger) advance(i int) error {
+	item, err := m.its[i].Next()
+	if err == io.EOF {
+		m.heads[i] = nil
+		m.done[i] = true
+		return nil
+	}
+	if err != nil {
+		m.err = err
+		return err
+	}
+	m.heads[i] = item
+	return nil
+}
+
+// HasNext reports whether Next has an item.
+func (m *Merger) HasNext() bool {
+	return m.err == nil && len(m.its) > 0 && !m.done[m.tree[0]]
+}
+
+// Next returns the smallest item, io.EOF when all iterators are exhausted
+// and the first error of an iterator otherwise.
+func (m *Merger) Next() (interface{}, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	if !m.HasNext() {
+		return nil, io.EOF
+	}
+	item, err := m.pop()
+	if err != nil {
+		return nil, err
+	}
+	for m.combine != nil && m.HasNext() && m.compare(m.heads[m.tree[0]], item) == 0 {
+		dup, err := m.pop()
+		if err != nil {
+			return nil, err
+		}
+		item = m.combine(item, dup)
+	}
+	return item, nil
+}
+
+func (m *Merger) pop() (interface{}, error) {
+	w := m.tree[0]
+	item := m.heads[w]
+	err := m.advance(w)
+	if err != nil {
+		return nil, err
+	}
+	m.adjust(w)
+	return item, nil
+}
@@ -0,0 +1,136 @@
+package merge
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+type item struct {
+	k, src, n int
+}
+
+func compareItems(a, b interface{}) int {
+	return a.(item).k - b.(item).k
+}
+
+func randomStreams(r *rand.Rand) ([]Iterator, []item) {
+	all := make([]item, 0)
+	its := make([]Iterator, r.Intn(9))
+	for i := range its {
+		n := r.Intn(4) * r.Intn(30)
+		keys := make([]int, n)
+		for j := range keys {
+			keys[j] = r.Intn(50)
+		}
+		sort.Ints(keys)
+		items := make([]interface{}, n)
+		for j, k := range keys {
+			items[j] = item{k: k, src: i, n: 1}
+			all = append(all, item{k: k, src: i, n: 1})
+		}
+		its[i] = Slice(items)
+	}
+	return its, all
+}
+
+func drain(t *testing.T, m *Merger) []item {
+	items := make([]item, 0)
+	for {
+		v, err := m.Next()
+		if err == io.EOF {
+			return items
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		items = append(items, v.(item))
+	}
+}
+
+func TestMerger(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for round := 0; round < 500; round++ {
+		its, all := randomStreams(r)
+		m, err := New(its, compareItems, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.SliceStable(all, func(i, j int) bool {
+			if all[i].k != all[j].k {
+				return all[i].k < all[j].k
+			}
+			return all[i].src < all[j].src
+		})
+		got := drain(t, m)
+		if len(got) != len(all) {
+			t.Fatalf("round %d: expect %d items, got %d", round, len(all), len(got))
+		}
+		for i := range got {
+			if got[i] != all[i] {
+				t.Fatalf("round %d: item %d expect %v, got %v", round, i, all[i], got[i])
+			}
+		}
+		if m.HasNext() {
+			t.Fatal("expect no next after EOF")
+		}
+	}
+}
+
+func TestMerger_Combine(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	for round := 0; round < 500; round++ {
+		its, all := randomStreams(r)
+		m, err := New(its, compareItems, func(kept, dup interface{}) interface{} {
+			k := kept.(item)
+			k.n += dup.(item).n
+			return k
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts := map[int]int{}
+		for _, it := range all {
+			counts[it.k]++
+		}
+		got := drain(t, m)
+		if len(got) != len(counts) {
+			t.Fatalf("round %d: expect %d keys, got %d", round, len(counts), len(got))
+		}
+		for i, it := range got {
+			if i > 0 && got[i-1].k >= it.k {
+				t.Fatalf("round %d: keys out of order %v", round, got)
+			}
+			if counts[it.k] != it.n {
+				t.Fatalf("round %d: key %d expect %d combined, got %d", round, it.k, counts[it.k], it.n)
+			}
+		}
+	}
+}
+
+func TestMerger_Error(t *testing.T) {
+	failed := errors.New("read failed")
+	calls := 0
+	broken := IteratorFunc(func() (interface{}, error) {
+		calls++
+		if calls > 1 {
+			return nil, failed
+		}
+		return item{k: 1}, nil
+	})
+	m, err := New([]Iterator{Slice([]interface{}{item{k: 0}, item{k: 2}}), broken}, compareItems, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := m.Next(); err != nil || v.(item).k != 0 {
+		t.Fatalf("expect 0, got %v %v", v, err)
+	}
+	if _, err := m.Next(); err != failed {
+		t.Fatalf("expect %v, got %v", failed, err)
+	}
+	if _, err := m.Next(); err != failed {
+		t.Fatalf("expect %v again, got %v", failed, err)
+	}
+}
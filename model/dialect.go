@@ -0,0 +1,65 @@
+package model
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+type Dialect struct {
+	Delimiter      string `json:"delimiter" yaml:"delimiter"`
+	LineTerminator string `json:"line_terminator" yaml:"line_terminator"`
+	Header         bool   `json:"header" yaml:"header"`
+	MapByHeader    bool   `json:"map_by_header" yaml:"map_by_header"`
+	StripBOM       bool   `json:"strip_bom" yaml:"strip_bom"`
+	Encoding       string `json:"encoding" yaml:"encoding"`
+}
+
+func DefaultDialect() Dialect {
+	return Dialect{
+		Delimiter:      ",",
+		LineTerminator: "\n",
+		StripBOM:       true,
+		Encoding:       "utf8mb4",
+	}
+}
+
+func (d Dialect) Validate() error {
+	if len(d.Delimiter) != 1 || d.Delimiter == "\n" || d.Delimiter == "\r" {
+		return fmt.Errorf("dialect: invalid delimiter %q", d.Delimiter)
+	}
+	if d.LineTerminator != "\n" && d.LineTerminator != "\r\n" {
+		return fmt.Errorf("dialect: invalid line terminator %q", d.LineTerminator)
+	}
+	if d.MapByHeader && !d.Header {
+		return fmt.Errorf("dialect: map_by_header requires header")
+	}
+	return nil
+}
+
+func (d Dialect) CRLF() bool {
+	return d.LineTerminator == "\r\n"
+}
+
+type plainDialect Dialect
+
+// UnmarshalJSON starts from the default dialect so partial configs only
+// override the keys they set.
+func (d *Dialect) UnmarshalJSON(data []byte) error {
+	v := plainDialect(DefaultDialect())
+	err := json.Unmarshal(data, &v)
+	if err != nil {
+		return err
+	}
+	*d = Dialect(v)
+	return nil
+}
+
+func (d *Dialect) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	v := plainDialect(DefaultDialect())
+	err := unmarshal(&v)
+	if err != nil {
+		return err
+	}
+	*d = Dialect(v)
+	return nil
+}
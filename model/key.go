@@ -0,0 +1,134 @@
+package model
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/shopspring/decimal"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Key is the typed identity of a row, compared column by column.
+type Key []Value
+
+func (k Key) Compare(o Key) int {
+	for i := 0; i < len(k) && i < len(o); i++ {
+		if c := k[i].Compare(o[i]); c != 0 {
+			return c
+		}
+	}
+	return compareInt(int64(len(k)), int64(len(o)))
+}
+
+func (k Key) String() string {
+	ss := make([]string, len(k))
+	for i, v := range k {
+		ss[i] = v.Source
+	}
+	return strings.Join(ss, ",")
+}
+
+// KeyCols returns the columns identifying a row, the primary key or every
+// column but updated_at when the table has none.
+func (m Meta) KeyCols() []string {
+	cols := m.PrimaryKeys
+	if len(cols) == 0 {
+		cols = m.Cols
+	}
+	keys := make([]string, 0, len(cols))
+	for _, col := range cols {
+		if col != "updated_at" {
+			keys = append(keys, col)
+		}
+	}
+	return keys
+}
+
+// ParseValue parses a field of col into a value that compares the way the
+// target database does, quoted fields are unquoted first.
+func (m Meta) ParseValue(col, s string) Value {
+	v := Value{Type: m.ColsType[col], Source: s}
+	if s == Null {
+		return v
+	}
+	if len(s) > 1 && s[0] == '\'' && s[len(s)-1] == '\'' {
+		s = unquote(s[1 : len(s)-1])
+	}
+	var err error
+	switch v.Type {
+	case Bigint:
+		if m.Unsigned[col] {
+			v.Value, err = strconv.ParseUint(s, 10, 64)
+		} else {
+			v.Value, err = TypeParser[Bigint](s)
+		}
+	case Double:
+		v.Value, err = strconv.ParseFloat(s, 64)
+	case Float:
+		// mysql stores float columns in single precision
+		v.Value, err = strconv.ParseFloat(s, 32)
+	case Decimal:
+		v.Value, err = decimal.NewFromString(s)
+	case Datetime:
+		v.Value, err = parseDatetime(s)
+	default:
+		v.Value = Collate(s, m.Collations[col])
+	}
+	if err != nil {
+		v.Value = s
+	}
+	return v
+}
+
+var unquoter = strings.NewReplacer("\\\\", "\\", "\\'", "'", "\\n", "\n", "\\r", "\r", "\\0", "\x00")
+
+// Text returns the source of a value without its quotes.
+func (v Value) Text() string {
+	s := v.Source
+	if len(s) > 1 && s[0] == '\'' && s[len(s)-1] == '\'' {
+		return unquote(s[1 : len(s)-1])
+	}
+	return s
+}
+
+func unquote(s string) string {
+	if strings.IndexByte(s, '\\') == -1 {
+		return s
+	}
+	return unquoter.Replace(s)
+}
+
+// Collate maps a string to its weight under a mysql collation so equal
+// strings compare equal: _ci collations fold case, the general, unicode and
+// _ai ones also ignore accents, and all but the 0900 ones ignore trailing spaces.
+func Collate(s, collation string) string {
+	if !strings.Contains(collation, "0900") {
+		s = strings.TrimRight(s, " ")
+	}
+	if collation == "" || collation == "binary" || strings.HasSuffix(collation, "_bin") || strings.HasSuffix(collation, "_cs") {
+		return s
+	}
+	if strings.HasSuffix(collation, "_general_ci") || strings.HasSuffix(collation, "_unicode_ci") || strings.HasSuffix(collation, "_ai_ci") {
+		t := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+		if r, _, err := transform.String(t, s); err == nil {
+			s = r
+		}
+	}
+	return strings.ToLower(s)
+}
+
+// DefaultCollation returns the collation mysql picks for a charset.
+func DefaultCollation(charset string) string {
+	switch charset {
+	case "", "binary":
+		return charset
+	case "utf8", "utf8mb3", "utf8mb4":
+		return charset + "_general_ci"
+	case "latin1":
+		return "latin1_swedish_ci"
+	}
+	return charset + "_general_ci"
+}
@@ -1,8 +1,10 @@
 package model
 
 import (
+	"github.com/shopspring/decimal"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type Type int
@@ -14,23 +16,71 @@ const (
 	Float
 	Char
 	Datetime
+	Decimal
 )
 
 func (t Type) IsString() bool {
 	return t == Char || t == Datetime
 }
 
+func (t Type) String() string {
+	switch t {
+	case Bigint:
+		return "bigint"
+	case Double:
+		return "double"
+	case Float:
+		return "float"
+	case Char:
+		return "char"
+	case Datetime:
+		return "datetime"
+	case Decimal:
+		return "decimal"
+	}
+	return "unknown"
+}
+
+var datetimeLayouts = []string{
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04:05.999999",
+	"2006-01-02",
+}
+
 var SqlTypeMapping = map[string]Type{
-	"bigint":   Bigint,
-	"double":   Double,
-	"float":    Float,
-	"char":     Char,
-	"datetime": Datetime,
+	"bigint":     Bigint,
+	"int":        Bigint,
+	"integer":    Bigint,
+	"mediumint":  Bigint,
+	"smallint":   Bigint,
+	"tinyint":    Bigint,
+	"double":     Double,
+	"real":       Double,
+	"float":      Float,
+	"decimal":    Decimal,
+	"numeric":    Decimal,
+	"char":       Char,
+	"varchar":    Char,
+	"text":       Char,
+	"tinytext":   Char,
+	"mediumtext": Char,
+	"longtext":   Char,
+	"binary":     Char,
+	"varbinary":  Char,
+	"datetime":   Datetime,
+	"timestamp":  Datetime,
+	"date":       Datetime,
 }
 
 var TypeParser = map[Type]func(str string) (interface{}, error){
 	Bigint: func(str string) (interface{}, error) {
-		return strconv.ParseInt(str, 10, 64)
+		v, err := strconv.ParseInt(str, 10, 64)
+		if err != nil {
+			if u, uerr := strconv.ParseUint(str, 10, 64); uerr == nil {
+				return u, nil
+			}
+		}
+		return v, err
 	},
 	Double: func(str string) (interface{}, error) {
 		return strconv.ParseFloat(str, 64)
@@ -38,25 +88,55 @@ var TypeParser = map[Type]func(str string) (interface{}, error){
 	Float: func(str string) (interface{}, error) {
 		return strconv.ParseFloat(str, 64)
 	},
+	Decimal: func(str string) (interface{}, error) {
+		return decimal.NewFromString(str)
+	},
 	Char: func(str string) (interface{}, error) {
 		return str, nil
 	},
 	Datetime: func(str string) (interface{}, error) {
+		_, err := parseDatetime(str)
+		if err != nil {
+			return nil, err
+		}
 		return str, nil
 	},
 }
 
+func parseDatetime(str string) (time.Time, error) {
+	var t time.Time
+	var err error
+	for _, layout := range datetimeLayouts {
+		t, err = time.Parse(layout, strings.Trim(str, "'"))
+		if err == nil {
+			return t, nil
+		}
+	}
+	return t, err
+}
+
 type Row struct {
-	Key    string
+	Key    Key
 	Source string
-	SortID int
+	// Fields are the values of the row in schema order before rendering.
+	Fields []string
+	// Origin is the index of the source of the row in its table and
+	// Offset where the source read it.
+	Origin int
+	Offset int64
 }
 
 func (r Row) Compare(r1 Row) bool {
-	if r.SortID == r1.SortID {
-		return r.Key > r1.Key
+	return r.Key.Compare(r1.Key) > 0
+}
+
+// Size estimates the bytes a row holds in memory.
+func (r Row) Size() int {
+	size := len(r.Source) + 80 + len(r.Key)*64
+	for _, f := range r.Fields {
+		size += len(f) + 16
 	}
-	return r.SortID > r1.SortID
+	return size
 }
 
 func (r Row) String() string {
@@ -78,10 +158,7 @@ func (rs Rows) Len() int {
 }
 
 func (rs Rows) Less(i, j int) bool {
-	if rs[i].SortID == rs[j].SortID {
-		return rs[i].Key < rs[j].Key
-	}
-	return rs[i].SortID < rs[j].SortID
+	return rs[i].Key.Compare(rs[j].Key) < 0
 }
 
 func (rs Rows) Swap(i, j int) {
@@ -103,43 +180,90 @@ func (v Value) String() string {
 }
 
 func (v Value) Equals(o Value) bool {
-	return v.Value == o.Value
+	return v.Compare(o) == 0
 }
 
+// Compare orders two values of a column, NULL sorts first and values that
+// failed to parse fall back to comparing their source text.
 func (v Value) Compare(o Value) int {
-	switch v.Type {
-	case Bigint:
-		if v.Value.(int64) > o.Value.(int64) {
-			return 1
-		} else if v.String() == o.String() {
-			return 0
-		} else {
+	if v.Value == nil || o.Value == nil {
+		switch {
+		case v.Value == nil && o.Value == nil:
+			return strings.Compare(v.Source, o.Source)
+		case v.Value == nil:
 			return -1
 		}
-	case Double:
-		if v.Value.(float64) > o.Value.(float64) {
-			return 1
-		} else if v.String() == o.String() {
-			return 0
-		} else {
-			return -1
+		return 1
+	}
+	switch a := v.Value.(type) {
+	case int64:
+		switch b := o.Value.(type) {
+		case int64:
+			return compareInt(a, b)
+		case uint64:
+			if a < 0 {
+				return -1
+			}
+			return compareUint(uint64(a), b)
 		}
-	case Float:
-		if v.Value.(float64) > o.Value.(float64) {
-			return 1
-		} else if v.String() == o.String() {
+	case uint64:
+		switch b := o.Value.(type) {
+		case uint64:
+			return compareUint(a, b)
+		case int64:
+			if b < 0 {
+				return 1
+			}
+			return compareUint(a, uint64(b))
+		}
+	case float64:
+		if b, ok := o.Value.(float64); ok {
+			switch {
+			case a < b:
+				return -1
+			case a > b:
+				return 1
+			}
 			return 0
-		} else {
-			return -1
 		}
-	case Char, Datetime:
-		if v.Value.(string) > o.Value.(string) {
-			return 1
-		} else if v.String() == o.String() {
+	case decimal.Decimal:
+		if b, ok := o.Value.(decimal.Decimal); ok {
+			return a.Cmp(b)
+		}
+	case time.Time:
+		if b, ok := o.Value.(time.Time); ok {
+			switch {
+			case a.Before(b):
+				return -1
+			case a.After(b):
+				return 1
+			}
 			return 0
-		} else {
-			return -1
 		}
+	case string:
+		if b, ok := o.Value.(string); ok {
+			return strings.Compare(a, b)
+		}
+	}
+	return strings.Compare(v.Source, o.Source)
+}
+
+func compareInt(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func compareUint(a, b uint64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
 	}
 	return 0
 }
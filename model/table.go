@@ -1,9 +1,12 @@
 package model
 
 import (
+	"fmt"
 	"github.com/ainilili/tdsql-competition/database"
 	"github.com/ainilili/tdsql-competition/file"
 	"github.com/ainilili/tdsql-competition/rver"
+	"path/filepath"
+	"strings"
 )
 
 type Table struct {
@@ -17,15 +20,110 @@ type Table struct {
 	Recover     *rver.Recover
 	SetRecovers map[string]*rver.Recover
 	Cols        string
+	MaxRejects  int
+	Conflict    Conflict
+	// Audit logs the rows superseded by the conflict policy.
+	Audit bool
+	// Dedup forces the dedup mode of the table, planned when empty.
+	Dedup string
+	// Partition routes the rows of the table to sets, by the tdsql hash
+	// of the proxy when empty.
+	Partition Partition
+}
+
+const (
+	PartitionTDSQL      = "tdsql"
+	PartitionRange      = "range"
+	PartitionList       = "list"
+	PartitionSingle     = "single"
+	PartitionConsistent = "consistent"
+)
+
+// Partition configures the partitioner of a table, Column is the shard key
+// and Sets the targets: ordered by less_than for range, with their values
+// for list, the ring members for consistent and the target for single.
+type Partition struct {
+	Type   string         `json:"type" yaml:"type"`
+	Column string         `json:"column" yaml:"column"`
+	Sets   []PartitionSet `json:"sets" yaml:"sets"`
+}
+
+type PartitionSet struct {
+	Set string `json:"set" yaml:"set"`
+	// LessThan bounds a range partition, empty means MAXVALUE.
+	LessThan string   `json:"less_than" yaml:"less_than"`
+	Values   []string `json:"values" yaml:"values"`
+}
+
+// ShardKey returns the column rows are routed by, the first primary key
+// column or the first column by default.
+func (t Table) ShardKey() string {
+	if t.Partition.Column != "" {
+		return t.Partition.Column
+	}
+	if len(t.Meta.PrimaryKeys) > 0 {
+		return t.Meta.PrimaryKeys[0]
+	}
+	if len(t.Meta.Cols) > 0 {
+		return t.Meta.Cols[0]
+	}
+	return ""
+}
+
+const (
+	DedupSort = "sort"
+	DedupHash = "hash"
+)
+
+const (
+	ConflictLatest   = "latest"
+	ConflictPriority = "priority"
+	ConflictFirst    = "first"
+	ConflictMerge    = "merge"
+)
+
+// Conflict chooses how rows with the same key are resolved, Column is the
+// timestamp or version column deciding the latest row, the last column by default.
+type Conflict struct {
+	Policy string `json:"policy" yaml:"policy"`
+	Column string `json:"column" yaml:"column"`
 }
 
 func (t Table) String() string {
 	return t.Database + "_" + t.Name
 }
 
+const (
+	FormatCSV       = "csv"
+	FormatJSONLines = "jsonl"
+	FormatParquet   = "parquet"
+	FormatMysqldump = "mysqldump"
+)
+
+// FormatOf guesses the format of a data file from its extension.
+func FormatOf(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".jsonl", ".ndjson":
+		return FormatJSONLines
+	case ".parquet":
+		return FormatParquet
+	case ".dump":
+		return FormatMysqldump
+	case ".csv", ".tsv":
+		return FormatCSV
+	}
+	return ""
+}
+
 type Source struct {
 	DataSource string
 	File       *file.File
+	Format     string
+	Dialect    Dialect
+	// Table names the table to read from a mysqldump file.
+	Table string
+	// Priority ranks the source when rows conflict, higher wins.
+	Priority int
 }
 
 type Meta struct {
@@ -35,4 +133,27 @@ type Meta struct {
 	ColsIndex    map[string]int
 	ColsType     map[string]Type
 	DefaultValue map[string]string
+	Unsigned     map[string]bool
+	Collations   map[string]string
+}
+
+// Null marks a NULL field, the marker LOAD DATA uses.
+const Null = "\\N"
+
+// Validate checks a source line split into fields against the schema.
+func (m Meta) Validate(fields []string) error {
+	if len(fields) != len(m.Cols) {
+		return fmt.Errorf("column count %d, expect %d", len(fields), len(m.Cols))
+	}
+	for i, col := range m.Cols {
+		t := m.ColsType[col]
+		if t == 0 || fields[i] == Null {
+			continue
+		}
+		_, err := TypeParser[t](fields[i])
+		if err != nil {
+			return fmt.Errorf("column %s: invalid %s %q", col, t, fields[i])
+		}
+	}
+	return nil
 }
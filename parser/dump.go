@@ -0,0 +1,569 @@
+package parser
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"github.com/ainilili/tdsql-competition/file"
+	"io"
+	"os"
+	"strings"
+)
+
+// DumpScanner reads the statements of a mysqldump file, it understands just
+// enough sql to find CREATE TABLE statements and the rows of extended INSERTs.
+type DumpScanner struct {
+	r        *bufio.Reader
+	pos      int64
+	capture  *bytes.Buffer
+	inValues bool
+	columns  []string
+	nulls    []bool
+}
+
+func NewDumpScanner(r io.Reader) *DumpScanner {
+	s := &DumpScanner{}
+	s.Reset(r)
+	return s
+}
+
+// Reset scans r from its start. The rows of an INSERT depend on the column
+// list of its header, so the scanner resumes no other position.
+func (s *DumpScanner) Reset(r io.Reader) {
+	s.r = bufio.NewReaderSize(r, 64*1024)
+	s.pos = 0
+	s.capture = nil
+	s.inValues = false
+	s.columns = nil
+}
+
+// Position returns the offset following the last row or statement read.
+func (s *DumpScanner) Position() int64 {
+	return s.pos
+}
+
+// Nulls tells which values of the last row read are NULL, they read as
+// empty strings.
+func (s *DumpScanner) Nulls() []bool {
+	return s.nulls
+}
+
+// Columns returns the column list of the current INSERT, nil if it has none.
+func (s *DumpScanner) Columns() []string {
+	return s.columns
+}
+
+func (s *DumpScanner) readByte() (byte, error) {
+	b, err := s.r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	s.pos++
+	if s.capture != nil {
+		s.capture.WriteByte(b)
+	}
+	return b, nil
+}
+
+func (s *DumpScanner) unreadByte() {
+	_ = s.r.UnreadByte()
+	s.pos--
+	if s.capture != nil {
+		s.capture.Truncate(s.capture.Len() - 1)
+	}
+}
+
+func (s *DumpScanner) peek() (byte, error) {
+	bs, err := s.r.Peek(1)
+	if err != nil {
+		return 0, err
+	}
+	return bs[0], nil
+}
+
+func isSpace(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\n' || b == '\r'
+}
+
+func isWord(b byte) bool {
+	return b == '_' || b == '$' || (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') || (b >= '0' && b <= '9')
+}
+
+// skipSpace skips whitespace and comments, /*! */ version comments included.
+func (s *DumpScanner) skipSpace() error {
+	for {
+		bs, err := s.r.Peek(2)
+		if len(bs) == 0 {
+			return err
+		}
+		b := bs[0]
+		comment := b == '#' || (len(bs) == 2 && ((b == '-' && bs[1] == '-') || (b == '/' && bs[1] == '*')))
+		if !isSpace(b) && !comment {
+			return nil
+		}
+		_, _ = s.readByte()
+		if !comment {
+			continue
+		}
+		if b == '/' {
+			_, _ = s.readByte()
+			var last byte
+			for !(last == '*' && b == '/') {
+				last = b
+				b, err = s.readByte()
+				if err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		for b != '\n' {
+			b, err = s.readByte()
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (s *DumpScanner) readWord() (string, error) {
+	buf := bytes.Buffer{}
+	for {
+		b, err := s.readByte()
+		if err != nil {
+			if err == io.EOF && buf.Len() > 0 {
+				return buf.String(), nil
+			}
+			return "", err
+		}
+		if !isWord(b) {
+			s.unreadByte()
+			return buf.String(), nil
+		}
+		buf.WriteByte(b)
+	}
+}
+
+// readIdent reads a possibly quoted and schema qualified identifier and
+// returns its last part.
+func (s *DumpScanner) readIdent() (string, error) {
+	name := ""
+	for {
+		err := s.skipSpace()
+		if err != nil {
+			return "", err
+		}
+		b, err := s.peek()
+		if err != nil {
+			return "", err
+		}
+		if b == '`' || b == '"' {
+			_, _ = s.readByte()
+			name, err = s.readQuoted(b)
+		} else {
+			name, err = s.readWord()
+		}
+		if err != nil {
+			return "", err
+		}
+		b, err = s.peek()
+		if err != nil || b != '.' {
+			return name, nil
+		}
+		_, _ = s.readByte()
+	}
+}
+
+// readQuoted reads up to the closing quote, the opening one already read.
+func (s *DumpScanner) readQuoted(quote byte) (string, error) {
+	buf := bytes.Buffer{}
+	for {
+		b, err := s.readByte()
+		if err != nil {
+			return "", err
+		}
+		if b == '\\' && quote != '`' {
+			b, err = s.readByte()
+			if err != nil {
+				return "", err
+			}
+			buf.WriteByte(unescape(b))
+			continue
+		}
+		if b == quote {
+			n, err := s.peek()
+			if err == nil && n == quote {
+				_, _ = s.readByte()
+				buf.WriteByte(quote)
+				continue
+			}
+			return buf.String(), nil
+		}
+		buf.WriteByte(b)
+	}
+}
+
+func unescape(b byte) byte {
+	switch b {
+	case '0':
+		return 0
+	case 'n':
+		return '\n'
+	case 'r':
+		return '\r'
+	case 't':
+		return '\t'
+	case 'b':
+		return '\b'
+	case 'Z':
+		return 0x1a
+	}
+	return b
+}
+
+// skipStatement skips to the end of the current statement.
+func (s *DumpScanner) skipStatement() error {
+	for {
+		b, err := s.readByte()
+		if err != nil {
+			return err
+		}
+		switch b {
+		case ';':
+			return nil
+		case '\'', '"', '`':
+			_, err = s.readQuoted(b)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (s *DumpScanner) expect(word string) error {
+	err := s.skipSpace()
+	if err != nil {
+		return err
+	}
+	w, err := s.readWord()
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(w, word) {
+		return fmt.Errorf("dump: expect %s at %d, got %q", word, s.pos, w)
+	}
+	return nil
+}
+
+// nextStatement skips to the start of the next statement and returns its first word.
+func (s *DumpScanner) nextStatement() (string, error) {
+	for {
+		err := s.skipSpace()
+		if err != nil {
+			return "", err
+		}
+		b, err := s.peek()
+		if err != nil {
+			return "", err
+		}
+		if b == ';' {
+			_, _ = s.readByte()
+			continue
+		}
+		w, err := s.readWord()
+		if err != nil {
+			return "", err
+		}
+		if w == "" {
+			err = s.skipStatement()
+			if err != nil {
+				return "", err
+			}
+			continue
+		}
+		return strings.ToUpper(w), nil
+	}
+}
+
+// NextCreateTable returns the next CREATE TABLE statement, without its semicolon.
+func (s *DumpScanner) NextCreateTable() (string, error) {
+	for {
+		w, err := s.nextStatement()
+		if err != nil {
+			return "", err
+		}
+		if w != "CREATE" {
+			err = s.skipStatement()
+			if err != nil {
+				return "", err
+			}
+			continue
+		}
+		s.capture = bytes.NewBufferString(w)
+		err = s.skipStatement()
+		stmt := s.capture.String()
+		s.capture = nil
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		stmt = strings.TrimSuffix(stmt, ";")
+		fields := strings.Fields(stmt)
+		if len(fields) > 1 && strings.EqualFold(fields[1], "TABLE") {
+			return stmt, nil
+		}
+	}
+}
+
+// NextRow returns the values of the next row inserted into table, table names
+// compare case insensitive.
+func (s *DumpScanner) NextRow(table string) ([]string, error) {
+	for {
+		if s.inValues {
+			err := s.skipSpace()
+			if err != nil {
+				return nil, err
+			}
+			b, err := s.readByte()
+			if err != nil {
+				return nil, err
+			}
+			if b == ',' {
+				return s.readTuple()
+			}
+			if b != ';' {
+				return nil, fmt.Errorf("dump: unexpected %q at %d", b, s.pos-1)
+			}
+			s.inValues = false
+		}
+		w, err := s.nextStatement()
+		if err != nil {
+			return nil, err
+		}
+		if w != "INSERT" && w != "REPLACE" {
+			err = s.skipStatement()
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		err = s.skipSpace()
+		if err != nil {
+			return nil, err
+		}
+		w, err = s.readWord()
+		if err != nil {
+			return nil, err
+		}
+		if strings.EqualFold(w, "IGNORE") {
+			w, err = s.readWord()
+			if err == nil && w == "" {
+				err = s.expect("INTO")
+			}
+		} else if !strings.EqualFold(w, "INTO") {
+			err = fmt.Errorf("dump: expect INTO at %d, got %q", s.pos, w)
+		}
+		if err != nil {
+			return nil, err
+		}
+		name, err := s.readIdent()
+		if err != nil {
+			return nil, err
+		}
+		if !strings.EqualFold(name, table) {
+			err = s.skipStatement()
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		err = s.skipSpace()
+		if err != nil {
+			return nil, err
+		}
+		b, err := s.peek()
+		if err != nil {
+			return nil, err
+		}
+		if b == '(' {
+			_, _ = s.readByte()
+			s.columns, err = s.readColumns()
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			s.columns = nil
+		}
+		err = s.expect("VALUES")
+		if err != nil {
+			return nil, err
+		}
+		s.inValues = true
+		return s.readTuple()
+	}
+}
+
+func (s *DumpScanner) readColumns() ([]string, error) {
+	columns := make([]string, 0)
+	for {
+		name, err := s.readIdent()
+		if err != nil {
+			return nil, err
+		}
+		columns = append(columns, strings.ToLower(name))
+		err = s.skipSpace()
+		if err != nil {
+			return nil, err
+		}
+		b, err := s.readByte()
+		if err != nil {
+			return nil, err
+		}
+		if b == ')' {
+			return columns, nil
+		}
+		if b != ',' {
+			return nil, fmt.Errorf("dump: unexpected %q in column list at %d", b, s.pos-1)
+		}
+	}
+}
+
+func (s *DumpScanner) readTuple() ([]string, error) {
+	err := s.skipSpace()
+	if err != nil {
+		return nil, err
+	}
+	b, err := s.readByte()
+	if err != nil {
+		return nil, err
+	}
+	if b != '(' {
+		return nil, fmt.Errorf("dump: expect ( at %d, got %q", s.pos-1, b)
+	}
+	values := make([]string, 0)
+	s.nulls = s.nulls[:0]
+	for {
+		v, null, err := s.readValue()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+		s.nulls = append(s.nulls, null)
+		err = s.skipSpace()
+		if err != nil {
+			return nil, err
+		}
+		b, err := s.readByte()
+		if err != nil {
+			return nil, err
+		}
+		if b == ')' {
+			return values, nil
+		}
+		if b != ',' {
+			return nil, fmt.Errorf("dump: unexpected %q in values at %d", b, s.pos-1)
+		}
+	}
+}
+
+// readValue returns a value decoded, strings unquoted and unescaped and
+// hex literals as their bytes, and whether it is NULL.
+func (s *DumpScanner) readValue() (string, bool, error) {
+	err := s.skipSpace()
+	if err != nil {
+		return "", false, err
+	}
+	b, err := s.readByte()
+	if err != nil {
+		return "", false, err
+	}
+	if b == '\'' || b == '"' {
+		v, err := s.readQuoted(b)
+		return v, false, err
+	}
+	if b == '_' {
+		// charset introducer like _binary 'abc'
+		_, err = s.readWord()
+		if err != nil {
+			return "", false, err
+		}
+		return s.readValue()
+	}
+	buf := bytes.Buffer{}
+	buf.WriteByte(b)
+	for {
+		b, err = s.readByte()
+		if err != nil {
+			return "", false, err
+		}
+		if b == ',' || b == ')' || isSpace(b) {
+			s.unreadByte()
+			break
+		}
+		buf.WriteByte(b)
+	}
+	v := buf.String()
+	if strings.EqualFold(v, "NULL") {
+		return "", true, nil
+	}
+	if strings.HasPrefix(v, "0x") || strings.HasPrefix(v, "0X") {
+		bs, err := hex.DecodeString(v[2:])
+		if err != nil {
+			return "", false, fmt.Errorf("dump: invalid hex %s at %d", v, s.pos)
+		}
+		return string(bs), false, nil
+	}
+	return v, false, nil
+}
+
+// ParseDumpSchemas returns the CREATE TABLE statements of a dump keyed by
+// table name, rewritten into the `CREATE TABLE if not exists` form the
+// loader expects.
+func ParseDumpSchemas(r io.Reader) ([]string, map[string]string, error) {
+	s := NewDumpScanner(r)
+	names := make([]string, 0)
+	schemas := map[string]string{}
+	for {
+		stmt, err := s.NextCreateTable()
+		if err == io.EOF {
+			return names, schemas, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		schema := normalizeCreateTable(stmt)
+		name := ParseTableStmt(schema).Name
+		if _, ok := schemas[name]; !ok {
+			names = append(names, name)
+		}
+		schemas[name] = schema
+	}
+}
+
+func ParseDumpFile(path string) ([]string, map[string]string, error) {
+	f, err := file.New(path, os.O_RDONLY)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	return ParseDumpSchemas(f)
+}
+
+func normalizeCreateTable(stmt string) string {
+	lines := strings.Split(stmt, "\n")
+	head := strings.Fields(lines[0])
+	i := 2
+	if len(head) > 4 && strings.EqualFold(head[2], "if") {
+		i = 5
+	}
+	if i >= len(head) {
+		return stmt
+	}
+	name := head[i]
+	if j := strings.LastIndex(name, "."); j != -1 {
+		name = name[j+1:]
+	}
+	head = append([]string{"CREATE TABLE if not exists", name}, head[i+1:]...)
+	lines[0] = strings.Join(head, " ")
+	return strings.Join(lines, "\n")
+}
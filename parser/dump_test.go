@@ -0,0 +1,77 @@
+package parser
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+const testDump = `-- MySQL dump 10.13  Distrib 5.7.36, for Linux (x86_64)
+--
+-- Host: localhost    Database: a
+/*!40101 SET @OLD_CHARACTER_SET_CLIENT=@@CHARACTER_SET_CLIENT */;
+/*!40103 SET TIME_ZONE='+00:00' */;
+
+DROP TABLE IF EXISTS ` + "`1`" + `;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+CREATE TABLE ` + "`1`" + ` (
+  ` + "`id`" + ` bigint(20) unsigned NOT NULL,
+  ` + "`b`" + ` char(32) DEFAULT NULL,
+  ` + "`updated_at`" + ` datetime NOT NULL DEFAULT '2021-12-12 00:00:00',
+  PRIMARY KEY (` + "`id`" + `)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+LOCK TABLES ` + "`1`" + ` WRITE;
+INSERT INTO ` + "`1`" + ` VALUES (1,'it\'s','2021-12-12 00:00:00'),(2,NULL,'2021-12-12 00:00:00'),(3,'a,b;c\n''d',_binary '2021-12-12 00:00:00');
+INSERT INTO ` + "`2`" + ` VALUES (9,'x');
+INSERT INTO ` + "`1`" + ` (` + "`id`, `updated_at`" + `) VALUES (4,'2021-12-13 00:00:00');
+UNLOCK TABLES;
+CREATE TABLE ` + "`2`" + ` (
+  ` + "`id`" + ` bigint(20) NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+`
+
+func TestParseDumpSchemas(t *testing.T) {
+	names, schemas, err := ParseDumpSchemas(strings.NewReader(testDump))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 2 || names[0] != "1" || names[1] != "2" {
+		t.Fatalf("unexpected tables %v", names)
+	}
+	if !strings.HasPrefix(schemas["1"], "CREATE TABLE if not exists `1` (") || !strings.HasSuffix(schemas["1"], "CHARSET=utf8") {
+		t.Fatalf("unexpected schema %s", schemas["1"])
+	}
+	meta := ParseTableMeta(schemas["1"])
+	if len(meta.Cols) != 3 || meta.PrimaryKeys[0] != "id" {
+		t.Fatalf("unexpected meta %+v", meta)
+	}
+}
+
+func TestDumpScanner_NextRow(t *testing.T) {
+	s := NewDumpScanner(strings.NewReader(testDump))
+	expects := [][]string{
+		{"1", "it's", "2021-12-12 00:00:00"},
+		{"2", "", "2021-12-12 00:00:00"},
+		{"3", "a,b;c\n'd", "2021-12-12 00:00:00"},
+		{"4", "2021-12-13 00:00:00"},
+	}
+	for i, expect := range expects {
+		values, err := s.NextRow("1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(values, "|") != strings.Join(expect, "|") {
+			t.Fatalf("row %d: expect %q, got %q", i, expect, values)
+		}
+		if null := s.Nulls()[1]; len(values) > 2 && null != (i == 1) {
+			t.Fatalf("row %d: expect NULL only in row 1", i)
+		}
+	}
+	if cols := s.Columns(); len(cols) != 2 || cols[1] != "updated_at" {
+		t.Fatalf("unexpected columns %v", cols)
+	}
+	if _, err := s.NextRow("1"); err != io.EOF {
+		t.Fatalf("expect eof, got %v", err)
+	}
+}
@@ -0,0 +1,213 @@
+package parser
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/ainilili/tdsql-competition/database"
+	"github.com/ainilili/tdsql-competition/file"
+	"github.com/ainilili/tdsql-competition/model"
+	"github.com/ainilili/tdsql-competition/util"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Manifest lists the tables to migrate explicitly instead of discovering them
+// from the data_path/<source>/<db>/<table>.csv layout, relative paths are
+// resolved against the directory of the manifest.
+type Manifest struct {
+	Tables []ManifestTable `json:"tables" yaml:"tables"`
+}
+
+type ManifestTable struct {
+	Database  string           `json:"database" yaml:"database"`
+	Name      string           `json:"name" yaml:"name"`
+	Schema    string           `json:"schema" yaml:"schema"`
+	Sources   []ManifestSource `json:"sources" yaml:"sources"`
+	Conflict  model.Conflict   `json:"conflict" yaml:"conflict"`
+	Audit     bool             `json:"audit" yaml:"audit"`
+	Dedup     string           `json:"dedup" yaml:"dedup"`
+	Partition model.Partition  `json:"partition" yaml:"partition"`
+}
+
+type ManifestSource struct {
+	Name     string         `json:"name" yaml:"name"`
+	Files    []string       `json:"files" yaml:"files"`
+	Format   string         `json:"format" yaml:"format"`
+	Dialect  *model.Dialect `json:"dialect" yaml:"dialect"`
+	Priority int            `json:"priority" yaml:"priority"`
+}
+
+// ReadManifest loads a json or yaml manifest and expands the file globs of its sources.
+func ReadManifest(path string) (*Manifest, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m := &Manifest{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yml", ".yaml":
+		err = yaml.Unmarshal(data, m)
+	default:
+		err = json.Unmarshal(data, m)
+	}
+	if err != nil {
+		return nil, err
+	}
+	dir, err := filepath.Abs(filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+	names := map[string]bool{}
+	for i := range m.Tables {
+		t := &m.Tables[i]
+		if t.Database == "" || t.Name == "" {
+			return nil, fmt.Errorf("manifest: table %d missing database or name", i)
+		}
+		key := t.Database + ":" + t.Name
+		if names[key] {
+			return nil, fmt.Errorf("manifest: duplicate table %s", key)
+		}
+		names[key] = true
+		if t.Dedup != "" && t.Dedup != model.DedupSort && t.Dedup != model.DedupHash {
+			return nil, fmt.Errorf("manifest: table %s unknown dedup %s", key, t.Dedup)
+		}
+		switch t.Partition.Type {
+		case "", model.PartitionTDSQL, model.PartitionSingle, model.PartitionConsistent:
+		case model.PartitionRange, model.PartitionList:
+			if len(t.Partition.Sets) == 0 {
+				return nil, fmt.Errorf("manifest: table %s %s partition without sets", key, t.Partition.Type)
+			}
+		default:
+			return nil, fmt.Errorf("manifest: table %s unknown partition %s", key, t.Partition.Type)
+		}
+		if len(t.Sources) == 0 {
+			return nil, fmt.Errorf("manifest: table %s has no sources", key)
+		}
+		if t.Schema != "" {
+			t.Schema = resolvePath(dir, t.Schema)
+		}
+		for j := range t.Sources {
+			s := &t.Sources[j]
+			if s.Dialect == nil {
+				dialect := model.DefaultDialect()
+				s.Dialect = &dialect
+			}
+			err = s.Dialect.Validate()
+			if err != nil {
+				return nil, fmt.Errorf("manifest: table %s source %s: %v", key, s.Name, err)
+			}
+			files := make([]string, 0, len(s.Files))
+			for _, pattern := range s.Files {
+				matches, err := filepath.Glob(resolvePath(dir, pattern))
+				if err != nil {
+					return nil, err
+				}
+				if len(matches) == 0 {
+					return nil, fmt.Errorf("manifest: table %s source %s: no files match %s", key, s.Name, pattern)
+				}
+				files = append(files, matches...)
+			}
+			s.Files = files
+			if t.Schema == "" && s.format(files[0]) == model.FormatMysqldump {
+				t.Schema = files[0]
+			}
+		}
+		if t.Schema == "" {
+			return nil, fmt.Errorf("manifest: table %s missing schema", key)
+		}
+	}
+	return m, nil
+}
+
+func ParseManifest(db *database.DB, path string) ([]*model.Table, error) {
+	m, err := ReadManifest(path)
+	if err != nil {
+		return nil, err
+	}
+	tables := make([]*model.Table, 0, len(m.Tables))
+	for _, mt := range m.Tables {
+		schema, err := readSchema(mt)
+		if err != nil {
+			return nil, err
+		}
+		if col := mt.Partition.Column; col != "" && util.IndexOf(ParseTableMeta(schema).KeyCols(), col) == -1 {
+			return nil, fmt.Errorf("manifest: table %s:%s partition column %s is not a key column", mt.Database, mt.Name, col)
+		}
+		t, err := newTable(db, len(tables)+1, mt.Database, mt.Name, schema)
+		if err != nil {
+			return nil, err
+		}
+		t.Conflict = mt.Conflict
+		t.Audit = mt.Audit
+		t.Dedup = mt.Dedup
+		t.Partition = mt.Partition
+		for _, ms := range mt.Sources {
+			for _, fp := range ms.Files {
+				f, err := file.New(fp, os.O_RDONLY)
+				if err != nil {
+					return nil, err
+				}
+				format := ms.format(fp)
+				t.Sources = append(t.Sources, model.Source{
+					DataSource: ms.Name,
+					File:       f,
+					Format:     format,
+					Dialect:    *ms.Dialect,
+					Priority:   ms.Priority,
+					Table:      mt.Name,
+				})
+			}
+		}
+		tables = append(tables, t)
+	}
+	return tables, nil
+}
+
+// readSchema reads the schema file of a table, a mysqldump file as schema
+// provides the CREATE TABLE of the table inside it.
+func readSchema(mt ManifestTable) (string, error) {
+	if !mt.dumpSchema() {
+		schema, err := ioutil.ReadFile(mt.Schema)
+		return string(schema), err
+	}
+	_, schemas, err := ParseDumpFile(mt.Schema)
+	if err != nil {
+		return "", err
+	}
+	schema, ok := schemas[strings.ToLower(mt.Name)]
+	if !ok {
+		return "", fmt.Errorf("manifest: no CREATE TABLE of %s in %s", mt.Name, mt.Schema)
+	}
+	return schema, nil
+}
+
+func (mt ManifestTable) dumpSchema() bool {
+	if model.FormatOf(mt.Schema) == model.FormatMysqldump {
+		return true
+	}
+	for _, s := range mt.Sources {
+		for _, fp := range s.Files {
+			if fp == mt.Schema && s.format(fp) == model.FormatMysqldump {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (ms ManifestSource) format(path string) string {
+	if ms.Format != "" {
+		return ms.Format
+	}
+	return model.FormatOf(path)
+}
+
+func resolvePath(dir, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
@@ -0,0 +1,91 @@
+package parser
+
+import (
+	"github.com/ainilili/tdsql-competition/database"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadManifest(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"orders.sql", "orders.0001.csv", "orders.0002.csv", "orders.csv"} {
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte{}, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	manifest := `
+tables:
+  - database: a
+    name: orders
+    schema: orders.sql
+    sources:
+      - name: src_a
+        files: ["orders.000*.csv"]
+        dialect:
+          delimiter: "|"
+        priority: 2
+      - name: src_b
+        files: ["orders.csv"]
+    partition:
+      type: range
+      sets:
+        - {set: s1, less_than: "100"}
+        - {set: s2}
+`
+	path := filepath.Join(dir, "manifest.yaml")
+	err := ioutil.WriteFile(path, []byte(manifest), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := ReadManifest(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := m.Tables[0]
+	if table.Schema != filepath.Join(dir, "orders.sql") {
+		t.Fatalf("unexpected schema %s", table.Schema)
+	}
+	a, b := table.Sources[0], table.Sources[1]
+	if len(a.Files) != 2 || a.Priority != 2 || a.Dialect.Delimiter != "|" || a.Dialect.LineTerminator != "\n" {
+		t.Fatalf("unexpected source %+v %+v", a, a.Dialect)
+	}
+	if len(b.Files) != 1 || b.Dialect.Delimiter != "," {
+		t.Fatalf("unexpected source %+v %+v", b, b.Dialect)
+	}
+	if p := table.Partition; p.Type != "range" || len(p.Sets) != 2 || p.Sets[0].LessThan != "100" || p.Sets[1].Set != "s2" {
+		t.Fatalf("unexpected partition %+v", p)
+	}
+
+	path = filepath.Join(dir, "manifest.json")
+	err = ioutil.WriteFile(path, []byte(`{"tables": [{"database": "a", "name": "orders", "schema": "orders.sql", "sources": [{"name": "src_a", "files": ["missing.*.csv"]}]}]}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ReadManifest(path)
+	if err == nil {
+		t.Fatal("expect unmatched glob error")
+	}
+}
+
+func TestParseManifest_PartitionColumn(t *testing.T) {
+	dir := t.TempDir()
+	schema := "CREATE TABLE if not exists `orders` (\n  `id` bigint(20) NOT NULL,\n  `b` char(32) NOT NULL,\n  PRIMARY KEY (`id`)\n) ENGINE=InnoDB"
+	err := ioutil.WriteFile(filepath.Join(dir, "orders.sql"), []byte(schema), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "orders.csv"), []byte{}, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "manifest.json")
+	err = ioutil.WriteFile(path, []byte(`{"tables": [{"database": "a", "name": "orders", "schema": "orders.sql", "partition": {"column": "b"}, "sources": [{"name": "src_a", "files": ["orders.csv"]}]}]}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ParseManifest(&database.DB{}, path); err == nil {
+		t.Fatal("expect a partition column out of the primary key to fail")
+	}
+}
@@ -2,6 +2,7 @@ package parser
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"github.com/ainilili/tdsql-competition/database"
 	"github.com/ainilili/tdsql-competition/file"
@@ -11,14 +12,20 @@ import (
 	"github.com/ainilili/tdsql-competition/util"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"regexp"
 	"strings"
 )
 
+const DialectFile = "dialect.json"
+
 type TableStmt struct {
 	Name        string
 	Cols        []Column
 	PrimaryKeys []string
 	Keys        []string
+	Charset     string
+	Collation   string
 }
 
 type Column struct {
@@ -26,6 +33,9 @@ type Column struct {
 	Type         string
 	Required     bool
 	DefaultValue string
+	Unsigned     bool
+	Charset      string
+	Collation    string
 }
 
 func ParseTableStmt(sql string) *TableStmt {
@@ -64,6 +74,9 @@ func ParseTableStmt(sql string) *TableStmt {
 				Type:         t,
 				Required:     required,
 				DefaultValue: defaultValue.String(),
+				Unsigned:     strings.Contains(line, " unsigned"),
+				Charset:      option(line, charsetOption),
+				Collation:    option(line, collationOption),
 			})
 		} else if strings.HasPrefix(line, "primary key") {
 			keys := strings.Split(strings.ReplaceAll(subs[2][1:len(subs[2])-1], "`", ""), ",")
@@ -72,22 +85,59 @@ func ParseTableStmt(sql string) *TableStmt {
 		} else if strings.HasPrefix(line, "key") {
 			keys := strings.Split(strings.ReplaceAll(subs[1][1:len(subs[1])-1], "`", ""), ",")
 			stmt.Keys = keys
+		} else if strings.HasPrefix(line, ")") {
+			stmt.Charset = option(line, charsetOption)
+			stmt.Collation = option(line, collationOption)
 		}
 	}
 	return stmt
 }
 
+var (
+	charsetOption   = regexp.MustCompile(`(?:character set|charset)\s*=?\s*'?(\w+)`)
+	collationOption = regexp.MustCompile(`collate\s*=?\s*'?(\w+)`)
+)
+
+// option returns the value of a table or column option such as
+// "collate utf8_bin" or "default charset=utf8".
+func option(line string, re *regexp.Regexp) string {
+	if m := re.FindStringSubmatch(line); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
 func ParseTableMeta(sql string) model.Meta {
 	stmt := ParseTableStmt(sql)
 	cols := make([]string, 0)
 	colsIndex := map[string]int{}
 	colsType := map[string]model.Type{}
 	defaultValue := map[string]string{}
+	unsigned := map[string]bool{}
+	collations := map[string]string{}
+	tableCollation := stmt.Collation
+	if tableCollation == "" {
+		tableCollation = model.DefaultCollation(stmt.Charset)
+	}
+	if tableCollation == "" {
+		tableCollation = database.Collation
+	}
 	for i, col := range stmt.Cols {
 		cols = append(cols, col.Name)
 		colsIndex[col.Name] = i
 		colsType[col.Name] = model.SqlTypeMapping[col.Type]
 		defaultValue[col.Name] = col.DefaultValue
+		unsigned[col.Name] = col.Unsigned
+		switch {
+		case col.Collation != "":
+			collations[col.Name] = col.Collation
+		case col.Charset != "":
+			collations[col.Name] = model.DefaultCollation(col.Charset)
+		case strings.HasSuffix(col.Type, "binary") || strings.HasSuffix(col.Type, "blob"):
+			collations[col.Name] = "binary"
+		default:
+			collations[col.Name] = tableCollation
+		}
 	}
 	return model.Meta{
 		PrimaryKeys:  stmt.PrimaryKeys,
@@ -96,7 +146,30 @@ func ParseTableMeta(sql string) model.Meta {
 		ColsIndex:    colsIndex,
 		ColsType:     colsType,
 		DefaultValue: defaultValue,
+		Unsigned:     unsigned,
+		Collations:   collations,
+	}
+}
+
+// ParseDialect reads a json dialect, keys left out keep their default value.
+func ParseDialect(data []byte) (model.Dialect, error) {
+	dialect := model.DefaultDialect()
+	err := json.Unmarshal(data, &dialect)
+	if err != nil {
+		return dialect, err
+	}
+	return dialect, dialect.Validate()
+}
+
+func ParseDialectFile(path string) (model.Dialect, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return model.DefaultDialect(), nil
+		}
+		return model.Dialect{}, err
 	}
+	return ParseDialect(data)
 }
 
 func ParseTables(db *database.DB, dataPath string) ([]*model.Table, error) {
@@ -105,16 +178,24 @@ func ParseTables(db *database.DB, dataPath string) ([]*model.Table, error) {
 		return nil, err
 	}
 	tables := make([]*model.Table, 0)
-	tableId := 1
 	tableMap := map[string]*model.Table{}
-	tablesMap := map[string][]*model.Table{}
 	for _, dataSourceFile := range dataSourceFiles {
+		if !dataSourceFile.IsDir() {
+			continue
+		}
 		databaseFiles, err := ioutil.ReadDir(util.AssemblePath(dataPath, dataSourceFile.Name()))
 		if err != nil {
 			return nil, err
 		}
 		dataSource := util.ParseName(dataSourceFile.Name())
+		dialect, err := ParseDialectFile(util.AssemblePath(dataPath, dataSourceFile.Name(), DialectFile))
+		if err != nil {
+			return nil, err
+		}
 		for _, databaseFile := range databaseFiles {
+			if !databaseFile.IsDir() {
+				continue
+			}
 			tableFiles, err := ioutil.ReadDir(util.AssemblePath(dataPath, dataSourceFile.Name(), databaseFile.Name()))
 			if err != nil {
 				return nil, err
@@ -124,12 +205,25 @@ func ParseTables(db *database.DB, dataPath string) ([]*model.Table, error) {
 			schemaFiles := map[string]*file.File{}
 			fileKeys := make([]string, 0)
 			for _, tableFile := range tableFiles {
-				f, err := file.New(util.AssemblePath(dataPath, dataSourceFile.Name(), databaseFile.Name(), tableFile.Name()), os.O_RDONLY)
+				ext := filepath.Ext(tableFile.Name())
+				format := model.FormatOf(tableFile.Name())
+				if tableFile.IsDir() || (format == "" && ext != ".sql") {
+					continue
+				}
+				path := util.AssemblePath(dataPath, dataSourceFile.Name(), databaseFile.Name(), tableFile.Name())
+				if format == model.FormatMysqldump {
+					tables, err = parseDump(db, tables, tableMap, dbName, dataSource, path)
+					if err != nil {
+						return nil, err
+					}
+					continue
+				}
+				f, err := file.New(path, os.O_RDONLY)
 				if err != nil {
 					return nil, err
 				}
-				fileKey := tableFile.Name()[:len(tableFile.Name())-4]
-				if strings.HasSuffix(tableFile.Name(), ".csv") {
+				fileKey := strings.TrimSuffix(tableFile.Name(), ext)
+				if format != "" {
 					dataFiles[fileKey] = f
 					fileKeys = append(fileKeys, fileKey)
 				} else {
@@ -137,53 +231,31 @@ func ParseTables(db *database.DB, dataPath string) ([]*model.Table, error) {
 				}
 			}
 			for _, k := range fileKeys {
-				schema, err := schemaFiles[k].ReadAll()
-				if err != nil {
-					log.Error(err)
-					return nil, err
-				}
 				data := dataFiles[k]
 				tableName := util.ParseName(data.Name())
 				tableKey := dbName + ":" + tableName
 				t, ok := tableMap[tableKey]
 				if !ok {
-					t = &model.Table{
-						ID:       tableId,
-						Name:     tableName,
-						Database: dbName,
-						Sources:  make([]model.Source, 0),
-						Schema:   string(schema),
-						DB:       db,
-						Meta:     ParseTableMeta(string(schema)),
+					if schemaFiles[k] == nil {
+						return nil, fmt.Errorf("missing schema of %s", data.Path())
 					}
-					r, err := rver.New(fmt.Sprintf("recover%d", t.ID))
+					schema, err := schemaFiles[k].ReadAll()
 					if err != nil {
+						log.Error(err)
 						return nil, err
 					}
-					t.Recover = r
-					for i, c := range t.Meta.Cols {
-						t.Cols += c
-						if i != len(t.Meta.Cols)-1 {
-							t.Cols += ","
-						}
-					}
-					setRecovers := map[string]*rver.Recover{}
-					for _, set := range db.Sets() {
-						r, err := rver.New(fmt.Sprintf("recover_offset_%d_%s", t.ID, set))
-						if err != nil {
-							return nil, err
-						}
-						setRecovers[set] = r
+					t, err = newTable(db, len(tables)+1, dbName, tableName, string(schema))
+					if err != nil {
+						return nil, err
 					}
-					t.SetRecovers = setRecovers
-					tableId++
 					tables = append(tables, t)
-					tablesMap[dbName] = append(tablesMap[dbName], t)
 					tableMap[tableKey] = t
 				}
 				t.Sources = append(t.Sources, model.Source{
 					File:       data,
 					DataSource: dataSource,
+					Format:     model.FormatOf(data.Path()),
+					Dialect:    dialect,
 				})
 			}
 		}
@@ -191,6 +263,67 @@ func ParseTables(db *database.DB, dataPath string) ([]*model.Table, error) {
 	return tables, nil
 }
 
+// parseDump adds the tables of a mysqldump file, each gets its own source
+// over the file reading only the rows inserted into it.
+func parseDump(db *database.DB, tables []*model.Table, tableMap map[string]*model.Table, dbName, dataSource, path string) ([]*model.Table, error) {
+	names, schemas, err := ParseDumpFile(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		tableKey := dbName + ":" + name
+		t, ok := tableMap[tableKey]
+		if !ok {
+			t, err = newTable(db, len(tables)+1, dbName, name, schemas[name])
+			if err != nil {
+				return nil, err
+			}
+			tables = append(tables, t)
+			tableMap[tableKey] = t
+		}
+		f, err := file.New(path, os.O_RDONLY)
+		if err != nil {
+			return nil, err
+		}
+		t.Sources = append(t.Sources, model.Source{
+			DataSource: dataSource,
+			File:       f,
+			Format:     model.FormatMysqldump,
+			Dialect:    model.DefaultDialect(),
+			Table:      name,
+		})
+	}
+	return tables, nil
+}
+
+func newTable(db *database.DB, id int, dbName, tableName, schema string) (*model.Table, error) {
+	t := &model.Table{
+		ID:       id,
+		Name:     tableName,
+		Database: dbName,
+		Sources:  make([]model.Source, 0),
+		Schema:   schema,
+		DB:       db,
+		Meta:     ParseTableMeta(schema),
+	}
+	r, err := rver.New(fmt.Sprintf("recover%d", t.ID))
+	if err != nil {
+		return nil, err
+	}
+	t.Recover = r
+	t.Cols = strings.Join(t.Meta.Cols, ",")
+	setRecovers := map[string]*rver.Recover{}
+	for _, set := range db.Sets() {
+		r, err := rver.New(fmt.Sprintf("recover_offset_%d_%s", t.ID, set))
+		if err != nil {
+			return nil, err
+		}
+		setRecovers[set] = r
+	}
+	t.SetRecovers = setRecovers
+	return t, nil
+}
+
 func distributeTables(tables []*model.Table) []*model.Table {
 	tableMap := map[string][]*model.Table{}
 	for i, table := range tables {
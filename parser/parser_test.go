@@ -9,3 +9,32 @@ func TestParseTableStmt(t *testing.T) {
 	t.Log(stmt.PrimaryKeys)
 	t.Log(stmt.Keys)
 }
+
+func TestParseDialect(t *testing.T) {
+	dialect, err := ParseDialect([]byte(`{"delimiter": "|", "line_terminator": "\r\n", "header": true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dialect.Delimiter != "|" || !dialect.CRLF() || !dialect.Header || !dialect.StripBOM {
+		t.Fatalf("unexpected dialect %+v", dialect)
+	}
+	_, err = ParseDialect([]byte(`{"delimiter": "||"}`))
+	if err == nil {
+		t.Fatal("expect invalid delimiter")
+	}
+}
+
+func TestParseTableMeta_Collation(t *testing.T) {
+	sql := "CREATE TABLE if not exists `t` (\n  `id` bigint(20) unsigned NOT NULL,\n  `a` varchar(32) COLLATE utf8mb4_bin NOT NULL,\n  `b` char(32) NOT NULL DEFAULT '',\n  PRIMARY KEY (`id`,`a`)\n) ENGINE=InnoDB DEFAULT CHARSET=utf8"
+	meta := ParseTableMeta(sql)
+	if !meta.Unsigned["id"] || meta.Unsigned["b"] {
+		t.Fatalf("unexpected unsigned %v", meta.Unsigned)
+	}
+	if meta.Collations["a"] != "utf8mb4_bin" || meta.Collations["b"] != "utf8_general_ci" {
+		t.Fatalf("unexpected collations %v", meta.Collations)
+	}
+	meta = ParseTableMeta("CREATE TABLE if not exists `t` (\n  `b` char(32) NOT NULL,\n  PRIMARY KEY (`b`)\n) ENGINE=InnoDB")
+	if meta.Collations["b"] != "utf8mb4_bin" {
+		t.Fatalf("unexpected collations %v", meta.Collations)
+	}
+}
@@ -0,0 +1,175 @@
+package partition
+
+import (
+	"fmt"
+	"github.com/ainilili/tdsql-competition/database"
+	"github.com/ainilili/tdsql-competition/model"
+	"strconv"
+	"time"
+)
+
+// ProbeDatabase holds the tables the self check inserts its probes into.
+const ProbeDatabase = "tdsql_route_check"
+
+// probes per bucket of each key type.
+const probesPerBucket = 4
+
+// Mismatch is a probe the proxy stored in another set than the partitioner
+// of a table routes it to.
+type Mismatch struct {
+	Table  string
+	Key    string
+	Bucket int
+	Local  string
+	Proxy  string
+}
+
+func (m Mismatch) String() string {
+	return fmt.Sprintf("table %s key %s bucket %d: local set %s, proxy set %s", m.Table, m.Key, m.Bucket, m.Local, m.Proxy)
+}
+
+// probeTypes are the column types probed for the types of shard keys.
+var probeTypes = map[model.Type]string{
+	model.Bigint:   "bigint",
+	model.Double:   "double",
+	model.Float:    "double",
+	model.Decimal:  "decimal(30,0)",
+	model.Datetime: "datetime",
+	model.Char:     "varchar(64)",
+}
+
+// Check inserts probe keys of the shard key type of every table through the
+// proxy without a set hint, asks every set which of them it holds and
+// compares with the sets the partitioner of the table routes them to.
+func Check(db *database.DB, tables []*model.Table) ([]Mismatch, error) {
+	_, err := db.Exec("", fmt.Sprintf("CREATE DATABASE IF NOT EXISTS `%s`", ProbeDatabase))
+	if err != nil {
+		return nil, err
+	}
+	probed := map[string]map[string]string{}
+	mismatches := make([]Mismatch, 0)
+	for _, t := range tables {
+		p, err := New(t)
+		if err != nil {
+			return nil, err
+		}
+		col := t.ShardKey()
+		typ := t.Meta.ColsType[col]
+		if _, ok := probeTypes[typ]; !ok {
+			typ = model.Char
+		}
+		def := probeTypes[typ]
+		if c := t.Meta.Collations[col]; typ == model.Char && c != "" {
+			def += " COLLATE " + c
+		}
+		keys := probeKeys(typ)
+		held, ok := probed[def]
+		if !ok {
+			held, err = probe(db, fmt.Sprintf("probe_%d", len(probed)), typ, def, keys)
+			if err != nil {
+				return nil, err
+			}
+			probed[def] = held
+		}
+		mismatches = append(mismatches, compare(t, p, keys, held)...)
+	}
+	return mismatches, nil
+}
+
+// probeKeys returns the probe keys of a type as literals of a source file,
+// each followed by the variants comparing equal to it: leading zeros, decimal
+// scales, other cases and trailing spaces.
+func probeKeys(typ model.Type) []string {
+	keys := make([]string, 0, 3*probesPerBucket*database.Buckets)
+	start := time.Date(2021, 12, 12, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < probesPerBucket*database.Buckets; i++ {
+		n := strconv.Itoa(i)
+		switch typ {
+		case model.Datetime:
+			keys = append(keys, "'"+start.Add(time.Duration(i)*time.Second).Format("2006-01-02 15:04:05")+"'")
+		case model.Char:
+			keys = append(keys, "'k"+n+"'", "'K"+n+"'", "'k"+n+" '")
+		case model.Bigint:
+			keys = append(keys, n, "00"+n)
+		default:
+			keys = append(keys, n, n+".0", n+".00")
+		}
+	}
+	return keys
+}
+
+// compare returns the keys the partitioner of a table routes to other sets
+// than the proxy holds them in, keys without a partition are not loaded.
+func compare(t *model.Table, p Partitioner, keys []string, held map[string]string) []Mismatch {
+	mismatches := make([]Mismatch, 0)
+	for _, key := range keys {
+		b, set, err := Route(t, p, key)
+		if err != nil {
+			continue
+		}
+		if held[key] != set {
+			mismatches = append(mismatches, Mismatch{Table: t.String(), Key: key, Bucket: b, Local: set, Proxy: held[key]})
+		}
+	}
+	return mismatches
+}
+
+// probe writes the keys to a table sharded by a column of a definition and
+// returns the set holding each key literal. Rows are told apart by the index
+// of their key, variants of a key compare equal to it.
+func probe(db *database.DB, name string, typ model.Type, def string, keys []string) (map[string]string, error) {
+	table := fmt.Sprintf("`%s`.`%s`", ProbeDatabase, name)
+	stmts := []string{
+		"DROP TABLE IF EXISTS " + table,
+		fmt.Sprintf("CREATE TABLE %s (`k` %s NOT NULL, `n` int NOT NULL, PRIMARY KEY (`k`,`n`)) ENGINE=InnoDB shardkey=k", table, def),
+	}
+	for _, stmt := range stmts {
+		if _, err := db.Exec("", stmt); err != nil {
+			return nil, err
+		}
+	}
+	defer db.Exec("", "DROP TABLE IF EXISTS "+table)
+	for i, key := range keys {
+		if _, err := db.Exec("", fmt.Sprintf("INSERT INTO %s (`k`,`n`) VALUES (%s,%d)", table, key, i)); err != nil {
+			return nil, err
+		}
+	}
+	held := map[string]string{}
+	for _, set := range db.Sets() {
+		rows, err := db.Query(set, fmt.Sprintf("%sSELECT `k`,`n` FROM %s", db.Hint(set), table))
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var k interface{}
+			n := 0
+			if err = rows.Scan(&k, &n); err != nil {
+				_ = rows.Close()
+				return nil, err
+			}
+			if n < 0 || n >= len(keys) || typ == model.Datetime && "'"+scanned(k)+"'" != keys[n] {
+				_ = rows.Close()
+				return nil, fmt.Errorf("probe %s: set %s holds unexpected row %v,%d", name, set, k, n)
+			}
+			held[keys[n]] = set
+		}
+		err = rows.Err()
+		_ = rows.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return held, nil
+}
+
+// scanned renders a scanned value as mysql prints it, a dsn with parseTime
+// scans datetimes as time.Time.
+func scanned(k interface{}) string {
+	switch x := k.(type) {
+	case time.Time:
+		return x.Format("2006-01-02 15:04:05")
+	case []byte:
+		return string(x)
+	}
+	return fmt.Sprint(k)
+}
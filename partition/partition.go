@@ -0,0 +1,347 @@
+// Package partition routes rows to the sets of the target.
+package partition
+
+import (
+	"fmt"
+	"github.com/ainilili/tdsql-competition/database"
+	"github.com/ainilili/tdsql-competition/model"
+	"github.com/ainilili/tdsql-competition/util"
+	"github.com/shopspring/decimal"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Partitioner puts rows into buckets by their shard key when sharding and
+// maps buckets to sets when loading. The bucket of a row never changes, the
+// set of a bucket follows the topology.
+type Partitioner interface {
+	Buckets() int
+	Bucket(v model.Value) (int, error)
+	Set(bucket int) string
+	Sets() []string
+}
+
+// New returns the partitioner configured for a table.
+func New(t *model.Table) (Partitioner, error) {
+	p := t.Partition
+	switch p.Type {
+	case "", model.PartitionTDSQL:
+		return &TDSQL{db: t.DB}, nil
+	case model.PartitionSingle:
+		set := ""
+		if len(p.Sets) > 0 {
+			set = p.Sets[0].Set
+		} else if t.DB != nil && len(t.DB.Sets()) > 0 {
+			set = t.DB.Sets()[0]
+		}
+		return &Single{set: set}, nil
+	case model.PartitionRange:
+		return NewRange(t.Meta, t.ShardKey(), p.Sets)
+	case model.PartitionList:
+		return NewList(t.Meta, t.ShardKey(), p.Sets)
+	case model.PartitionConsistent:
+		sets := make([]string, len(p.Sets))
+		for i, s := range p.Sets {
+			sets[i] = s.Set
+		}
+		if len(sets) == 0 && t.DB != nil {
+			sets = t.DB.Sets()
+		}
+		return NewConsistent(sets), nil
+	}
+	return nil, fmt.Errorf("table %s: unknown partition type %s", t, p.Type)
+}
+
+// hash is the tdsql shard key hash of the canonical text of a value.
+func hash(v model.Value) uint32 {
+	return util.MurmurHash2([]byte(canonical(v)), 2773)
+}
+
+// canonical renders the typed, collated value of a key so that values
+// comparing equal hash the same, e.g. 007 as 7 and 1.0 as 1. Values that did
+// not parse keep their text.
+func canonical(v model.Value) string {
+	switch x := v.Value.(type) {
+	case nil:
+		return v.Text()
+	case int64:
+		return strconv.FormatInt(x, 10)
+	case uint64:
+		return strconv.FormatUint(x, 10)
+	case float64:
+		if v.Type == model.Float {
+			return strconv.FormatFloat(x, 'g', -1, 32)
+		}
+		return strconv.FormatFloat(x, 'g', -1, 64)
+	case decimal.Decimal:
+		return x.String()
+	case time.Time:
+		return x.Format("2006-01-02 15:04:05.999999")
+	case string:
+		return x
+	}
+	return fmt.Sprint(v.Value)
+}
+
+// TDSQL routes by the hash the proxy uses, buckets are the hash_range slots
+// of the sets.
+type TDSQL struct {
+	db *database.DB
+}
+
+func (p *TDSQL) Buckets() int {
+	return database.Buckets
+}
+
+func (p *TDSQL) Bucket(v model.Value) (int, error) {
+	return int(hash(v) % database.Buckets), nil
+}
+
+func (p *TDSQL) Set(bucket int) string {
+	return p.db.Hash()[bucket]
+}
+
+func (p *TDSQL) Sets() []string {
+	return p.db.Sets()
+}
+
+// Single sends every row to one set.
+type Single struct {
+	set string
+}
+
+func (p *Single) Buckets() int {
+	return 1
+}
+
+func (p *Single) Bucket(model.Value) (int, error) {
+	return 0, nil
+}
+
+func (p *Single) Set(int) string {
+	return p.set
+}
+
+func (p *Single) Sets() []string {
+	return []string{p.set}
+}
+
+// Range routes a row to the first partition its shard key is less than,
+// each partition is a bucket.
+type Range struct {
+	bounds []model.Value
+	sets   []string
+}
+
+func NewRange(meta model.Meta, col string, sets []model.PartitionSet) (*Range, error) {
+	if _, ok := meta.ColsIndex[col]; !ok {
+		return nil, fmt.Errorf("partition column %s not found", col)
+	}
+	p := &Range{}
+	for i, s := range sets {
+		if s.LessThan == "" {
+			if i != len(sets)-1 {
+				return nil, fmt.Errorf("range partition %d: only the last may be MAXVALUE", i)
+			}
+			p.bounds = append(p.bounds, model.Value{})
+		} else {
+			bound := meta.ParseValue(col, s.LessThan)
+			if i > 0 && p.bounds[i-1].Compare(bound) >= 0 {
+				return nil, fmt.Errorf("range partition %d: bounds must increase", i)
+			}
+			p.bounds = append(p.bounds, bound)
+		}
+		p.sets = append(p.sets, s.Set)
+	}
+	if len(p.sets) == 0 {
+		return nil, fmt.Errorf("range partition without sets")
+	}
+	return p, nil
+}
+
+func (p *Range) Buckets() int {
+	return len(p.sets)
+}
+
+func (p *Range) Bucket(v model.Value) (int, error) {
+	i := sort.Search(len(p.bounds), func(i int) bool {
+		return p.bounds[i].Source == "" || v.Compare(p.bounds[i]) < 0
+	})
+	if i == len(p.bounds) {
+		return 0, fmt.Errorf("no range partition for %s", v.Source)
+	}
+	return i, nil
+}
+
+func (p *Range) Set(bucket int) string {
+	return p.sets[bucket]
+}
+
+func (p *Range) Sets() []string {
+	return distinct(p.sets)
+}
+
+// List routes a row to the partition listing its shard key, a partition
+// without values takes the keys no other lists.
+type List struct {
+	values map[string]int
+	other  int
+	sets   []string
+}
+
+func NewList(meta model.Meta, col string, sets []model.PartitionSet) (*List, error) {
+	if _, ok := meta.ColsIndex[col]; !ok {
+		return nil, fmt.Errorf("partition column %s not found", col)
+	}
+	p := &List{values: map[string]int{}, other: -1}
+	for i, s := range sets {
+		if len(s.Values) == 0 {
+			p.other = i
+		}
+		for _, v := range s.Values {
+			key := listKey(meta.ParseValue(col, v))
+			if _, ok := p.values[key]; ok {
+				return nil, fmt.Errorf("list partition %d: value %s listed twice", i, v)
+			}
+			p.values[key] = i
+		}
+		p.sets = append(p.sets, s.Set)
+	}
+	if len(p.sets) == 0 {
+		return nil, fmt.Errorf("list partition without sets")
+	}
+	return p, nil
+}
+
+// listKey renders a value so that values comparing equal render the same.
+func listKey(v model.Value) string {
+	if v.Value == nil {
+		return "\x00" + v.Source
+	}
+	return fmt.Sprintf("%T:%v", v.Value, v.Value)
+}
+
+func (p *List) Buckets() int {
+	return len(p.sets)
+}
+
+func (p *List) Bucket(v model.Value) (int, error) {
+	if i, ok := p.values[listKey(v)]; ok {
+		return i, nil
+	}
+	if p.other >= 0 {
+		return p.other, nil
+	}
+	return 0, fmt.Errorf("no list partition for %s", v.Source)
+}
+
+func (p *List) Set(bucket int) string {
+	return p.sets[bucket]
+}
+
+func (p *List) Sets() []string {
+	return distinct(p.sets)
+}
+
+const (
+	consistentSlots = 64
+	virtualNodes    = 160
+)
+
+// Consistent hashes rows into slots placed on a ring of the sets, adding or
+// removing a set moves only the slots next to its points.
+type Consistent struct {
+	points []uint32
+	owners []string
+	sets   []string
+}
+
+func NewConsistent(sets []string) *Consistent {
+	p := &Consistent{sets: sets}
+	type point struct {
+		hash uint32
+		set  string
+	}
+	points := make([]point, 0, len(sets)*virtualNodes)
+	for _, set := range sets {
+		for i := 0; i < virtualNodes; i++ {
+			points = append(points, point{util.MurmurHash2([]byte(fmt.Sprintf("%s#%d", set, i)), 2773), set})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].hash != points[j].hash {
+			return points[i].hash < points[j].hash
+		}
+		return points[i].set < points[j].set
+	})
+	for _, pt := range points {
+		p.points = append(p.points, pt.hash)
+		p.owners = append(p.owners, pt.set)
+	}
+	return p
+}
+
+func (p *Consistent) Buckets() int {
+	return consistentSlots
+}
+
+func (p *Consistent) Bucket(v model.Value) (int, error) {
+	return int(hash(v) % consistentSlots), nil
+}
+
+// Set returns the owner of the first point from the slot on the ring.
+func (p *Consistent) Set(bucket int) string {
+	if len(p.points) == 0 {
+		return ""
+	}
+	h := uint32(uint64(bucket) * (1 << 32) / consistentSlots)
+	i := sort.Search(len(p.points), func(i int) bool {
+		return p.points[i] >= h
+	})
+	if i == len(p.points) {
+		i = 0
+	}
+	return p.owners[i]
+}
+
+func (p *Consistent) Sets() []string {
+	return p.sets
+}
+
+func distinct(sets []string) []string {
+	seen := map[string]bool{}
+	out := make([]string, 0, len(sets))
+	for _, s := range sets {
+		if !seen[s] {
+			seen[s] = true
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// Validate checks the sets of a partitioner exist on the target.
+func Validate(p Partitioner, db *database.DB) error {
+	if db == nil {
+		return nil
+	}
+	known := strings.Join(db.Sets(), ",")
+	for _, set := range p.Sets() {
+		if util.IndexOf(db.Sets(), set) == -1 {
+			return fmt.Errorf("partition set %s not among %s", set, known)
+		}
+	}
+	return nil
+}
+
+// Route returns the bucket and set of a shard key value of a table, given
+// as in a source file.
+func Route(t *model.Table, p Partitioner, key string) (int, string, error) {
+	b, err := p.Bucket(t.Meta.ParseValue(t.ShardKey(), key))
+	if err != nil {
+		return 0, "", err
+	}
+	return b, p.Set(b), nil
+}
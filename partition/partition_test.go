@@ -0,0 +1,230 @@
+package partition
+
+import (
+	"github.com/ainilili/tdsql-competition/database"
+	"github.com/ainilili/tdsql-competition/model"
+	"github.com/ainilili/tdsql-competition/parser"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSchema = "CREATE TABLE if not exists `2` (\n  `id` bigint(20) unsigned NOT NULL,\n  `b` char(32) NOT NULL DEFAULT '',\n  PRIMARY KEY (`id`)\n) ENGINE=InnoDB DEFAULT CHARSET=utf8"
+
+func testTable(p model.Partition) *model.Table {
+	hash := make([]string, database.Buckets)
+	for i := range hash {
+		hash[i] = "a"
+		if i >= database.Buckets/2 {
+			hash[i] = "b"
+		}
+	}
+	db := &database.DB{}
+	db.SetTopology([]string{"a", "b"}, hash)
+	return &model.Table{ID: 1, Meta: parser.ParseTableMeta(testSchema), DB: db, Partition: p}
+}
+
+func route(t *testing.T, p Partitioner, table *model.Table, col, v string) string {
+	table.Partition.Column = col
+	_, set, err := Route(table, p, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return set
+}
+
+func TestTDSQL(t *testing.T) {
+	table := testTable(model.Partition{})
+	p, err := New(table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := p.Bucket(table.Meta.ParseValue("id", "7"))
+	if b != int(hash(model.Value{Source: "7"})%database.Buckets) {
+		t.Fatalf("unexpected bucket %d", b)
+	}
+	// strings hash without their quotes
+	x, _ := p.Bucket(table.Meta.ParseValue("b", "'x'"))
+	y, _ := p.Bucket(model.Value{Source: "x"})
+	if x != y {
+		t.Fatalf("expect %d, got %d", y, x)
+	}
+	table.DB.SetTopology([]string{"c"}, make([]string, database.Buckets))
+	if p.Set(b) != "" {
+		t.Fatalf("expect the set to follow the topology")
+	}
+}
+
+func TestTDSQL_Canonical(t *testing.T) {
+	meta := parser.ParseTableMeta("CREATE TABLE if not exists `3` (\n  `i` bigint(20) NOT NULL,\n  `f` float NOT NULL,\n  `d` decimal(10,2) NOT NULL,\n  `b` char(32) NOT NULL,\n  `t` datetime NOT NULL\n) ENGINE=InnoDB DEFAULT CHARSET=utf8")
+	p := &TDSQL{}
+	equal := [][3]string{
+		{"i", "7", "007"},
+		{"f", "0.1", "0.100000001"},
+		{"d", "1", "1.0"},
+		{"d", "2.5", "2.50"},
+		{"b", "'Abc'", "'abc '"},
+		{"t", "'2021-12-12 00:00:00'", "'2021-12-12 00:00:00.000'"},
+	}
+	for _, e := range equal {
+		x, _ := p.Bucket(meta.ParseValue(e[0], e[1]))
+		y, _ := p.Bucket(meta.ParseValue(e[0], e[2]))
+		if x != y {
+			t.Fatalf("%s: expect %s and %s in one bucket, got %d and %d", e[0], e[1], e[2], x, y)
+		}
+	}
+	// canonical keys hash their text like the proxy
+	for _, e := range [][2]string{{"i", "7"}, {"f", "0.5"}, {"d", "2.5"}, {"b", "'abc'"}, {"t", "'2021-12-12 00:00:00'"}} {
+		if c := canonical(meta.ParseValue(e[0], e[1])); c != strings.Trim(e[1], "'") {
+			t.Fatalf("%s: expect %s canonical, got %s", e[0], e[1], c)
+		}
+	}
+}
+
+func TestRange(t *testing.T) {
+	table := testTable(model.Partition{Type: model.PartitionRange, Sets: []model.PartitionSet{
+		{Set: "a", LessThan: "100"},
+		{Set: "b", LessThan: "1000"},
+	}})
+	p, err := New(table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for v, set := range map[string]string{"0": "a", "99": "a", "100": "b", "999": "b"} {
+		if s := route(t, p, table, "id", v); s != set {
+			t.Fatalf("%s: expect %s, got %s", v, set, s)
+		}
+	}
+	if _, err := p.Bucket(table.Meta.ParseValue("id", "1000")); err == nil {
+		t.Fatal("expect no partition for 1000")
+	}
+	table.Partition.Sets = append(table.Partition.Sets, model.PartitionSet{Set: "a"})
+	if p, err = New(table); err != nil {
+		t.Fatal(err)
+	}
+	if s := route(t, p, table, "id", "5000"); s != "a" {
+		t.Fatalf("expect MAXVALUE partition a, got %s", s)
+	}
+	table.Partition.Sets[1].LessThan = "10"
+	if _, err = New(table); err == nil {
+		t.Fatal("expect decreasing bounds to fail")
+	}
+}
+
+func TestList(t *testing.T) {
+	table := testTable(model.Partition{Type: model.PartitionList, Column: "b", Sets: []model.PartitionSet{
+		{Set: "a", Values: []string{"x", "y"}},
+		{Set: "b", Values: []string{"z"}},
+	}})
+	p, err := New(table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := route(t, p, table, "b", "'y'"); s != "a" {
+		t.Fatalf("expect a, got %s", s)
+	}
+	if s := route(t, p, table, "b", "'z'"); s != "b" {
+		t.Fatalf("expect b, got %s", s)
+	}
+	if _, err := p.Bucket(table.Meta.ParseValue("b", "'w'")); err == nil {
+		t.Fatal("expect no partition for w")
+	}
+	if len(p.Sets()) != 2 {
+		t.Fatalf("expect 2 sets, got %v", p.Sets())
+	}
+}
+
+func TestSingle(t *testing.T) {
+	table := testTable(model.Partition{Type: model.PartitionSingle})
+	p, err := New(table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Buckets() != 1 || route(t, p, table, "id", "42") != "a" {
+		t.Fatalf("expect every row on a")
+	}
+}
+
+func TestConsistent(t *testing.T) {
+	two := NewConsistent([]string{"a", "b"})
+	three := NewConsistent([]string{"a", "b", "c"})
+	counts := map[string]int{}
+	moved := 0
+	for b := 0; b < two.Buckets(); b++ {
+		counts[two.Set(b)]++
+		if s := three.Set(b); s != two.Set(b) {
+			if s != "c" {
+				t.Fatalf("slot %d moved from %s to %s", b, two.Set(b), s)
+			}
+			moved++
+		}
+	}
+	if counts["a"] == 0 || counts["b"] == 0 {
+		t.Fatalf("expect slots on both sets, got %v", counts)
+	}
+	if moved == 0 || moved == two.Buckets() {
+		t.Fatalf("expect some slots to move, got %d", moved)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	table := testTable(model.Partition{Type: model.PartitionSingle, Sets: []model.PartitionSet{{Set: "x"}}})
+	p, err := New(table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = Validate(p, table.DB); err == nil {
+		t.Fatal("expect unknown set x to fail")
+	}
+}
+
+func TestCompare(t *testing.T) {
+	// the proxy routes by the tdsql hash of the key value
+	table := testTable(model.Partition{})
+	proxy := &TDSQL{db: table.DB}
+	held, raw := map[string]string{}, map[string]string{}
+	for _, col := range []string{"id", "b"} {
+		for _, key := range probeKeys(table.Meta.ColsType[col]) {
+			b, _ := proxy.Bucket(table.Meta.ParseValue(col, key))
+			held[key] = proxy.Set(b)
+			b, _ = proxy.Bucket(model.Value{Source: key})
+			raw[key] = proxy.Set(b)
+		}
+	}
+	p, err := New(table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, col := range []string{"id", "b"} {
+		table.Partition.Column = col
+		keys := probeKeys(table.Meta.ColsType[col])
+		if m := compare(table, p, keys, held); len(m) != 0 {
+			t.Fatalf("%s: expect no mismatches, got %v", col, m)
+		}
+		// a proxy hashing the literal text splits the variants of a key
+		m := compare(table, p, keys, raw)
+		if len(m) == 0 {
+			t.Fatalf("%s: expect variants to differ from a proxy hashing the text", col)
+		}
+		for _, mismatch := range m {
+			if canonical(table.Meta.ParseValue(col, mismatch.Key)) == strings.Trim(mismatch.Key, "'") {
+				t.Fatalf("%s: expect only variants to mismatch, got %v", col, mismatch)
+			}
+		}
+	}
+	table = testTable(model.Partition{Type: model.PartitionRange, Column: "id", Sets: []model.PartitionSet{
+		{Set: "a", LessThan: "100"},
+		{Set: "b"},
+	}})
+	if p, err = New(table); err != nil {
+		t.Fatal(err)
+	}
+	if m := compare(table, p, probeKeys(model.Bigint), held); len(m) == 0 || m[0].Table != table.String() {
+		t.Fatalf("expect a range partitioner to differ from the proxy, got %v", m)
+	}
+	// datetimes scan as text or, with parseTime, as time.Time
+	at := time.Date(2021, 12, 12, 0, 0, 1, 0, time.UTC)
+	if s := scanned(at); s != "2021-12-12 00:00:01" || scanned([]byte(s)) != s {
+		t.Fatalf("unexpected scanned datetime %s", s)
+	}
+}
@@ -0,0 +1,36 @@
+package util
+
+import (
+	"fmt"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"strings"
+)
+
+var charsets = map[string]encoding.Encoding{
+	"gbk":     simplifiedchinese.GBK,
+	"gb2312":  simplifiedchinese.GBK,
+	"gb18030": simplifiedchinese.GB18030,
+	// mysql latin1 is cp1252, not iso-8859-1
+	"latin1":     charmap.Windows1252,
+	"cp1252":     charmap.Windows1252,
+	"iso-8859-1": charmap.ISO8859_1,
+}
+
+// Transcoder returns a function converting bytes of the given charset into utf8,
+// nil means the input is utf8 already.
+func Transcoder(charset string) (func(src []byte) ([]byte, error), error) {
+	charset = strings.ToLower(charset)
+	switch charset {
+	case "", "utf8", "utf8mb4", "utf-8":
+		return nil, nil
+	}
+	enc, ok := charsets[charset]
+	if !ok {
+		return nil, fmt.Errorf("unsupported charset %s", charset)
+	}
+	return func(src []byte) ([]byte, error) {
+		return enc.NewDecoder().Bytes(src)
+	}, nil
+}
@@ -0,0 +1,29 @@
+//go:build !windows
+// +build !windows
+
+package util
+
+import (
+	"strconv"
+	"syscall"
+)
+
+// FreeSpace returns the bytes available to the process on the file system of path.
+func FreeSpace(path string) (uint64, error) {
+	st := syscall.Statfs_t{}
+	err := syscall.Statfs(path, &st)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
+
+// Device names the file system of path, paths on the same one share its name.
+func Device(path string) (string, error) {
+	st := syscall.Stat_t{}
+	err := syscall.Stat(path, &st)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatUint(uint64(st.Dev), 10), nil
+}